@@ -0,0 +1,137 @@
+// big ints
+// ints which do not fit into the 60 bits of a value are promoted to big
+// ints. A big int is a block of cells like a vector: a header (n . sign)
+// followed by the n words of its absolute value, lowest word first.
+// Results which fit into a value are ints again, so each number has only
+// one form, and eq compares big ints by their words.
+package main
+
+import "math/big"
+
+const wordBits = 32   // bits of a word of a big int
+
+func fits(x int) bool {return x >= minInt && x <= maxInt}
+
+// int or big int
+func isInteger(x value) bool {return isInt(x) || isBig(x)}
+
+func (vm *Vm) bigOf(x value) *big.Int {
+    if isInt(x) {
+        return big.NewInt(int64(unbox(x)))
+    }
+    z, w := new(big.Int), new(big.Int)
+    for i := vm.vecLen(x)-1; i >= 0; i-- {
+        z.Lsh(z, wordBits)
+        z.Or(z, w.SetInt64(int64(unbox(vm.vecAt(x, i)))))
+    }
+    if unbox(vm.cdr(x)) < 0 {
+        z.Neg(z)
+    }
+    return z
+}
+
+// int or big int of z, does not run the gc, see reserveBig
+func (vm *Vm) newBig(z *big.Int) value {
+    if z.IsInt64() && fits(int(z.Int64())) {
+        return boxInt(int(z.Int64()))
+    }
+    var xs []value
+    a, w := new(big.Int).Abs(z), new(big.Int)
+    mask := big.NewInt(1<<wordBits - 1)
+    for a.Sign() > 0 {
+        xs = append(xs, boxInt(int(w.And(a, mask).Int64())))
+        a.Rsh(a, wordBits)
+    }
+    return boxBig(vm.newBlock(xs, boxInt(z.Sign())))
+}
+
+// cells needed for the result of an operation on x and y
+func (vm *Vm) bigNeed(op mathOp, x, y value) int {
+    if op.words != nil && isInteger(x) && isInteger(y) {
+        return blockCells(clip(op.words(vm, x, y), 0, len(vm.arena))) + 1
+    }
+    n := 4   // an int, or the overflow of an operation on ints
+    for _, v := range []value{x, y} {
+        if isBig(v) {
+            n += vm.vecLen(v)
+        }
+    }
+    return blockCells(n) + 1
+}
+
+// run the gc now if a big int is involved, which may need more cells
+// than are kept free between two gc checks
+func (vm *Vm) reserveBig(op mathOp, x, y *value) {
+    if isBig(*x) || isBig(*y) || op.words != nil {
+        mark := vm.protect(x, y)
+        vm.reserve(vm.bigNeed(op, *x, *y))
+        vm.unprotect(mark)
+    }
+}
+
+// operation of a math primitive, on ints, big ints and floats
+// unary operations ignore y
+type mathOp struct {
+    int   mathIntFunc
+    big   func(x, y *big.Int) *big.Int
+    words func(vm *Vm, x, y value) int   // size of a result that grows more than x and y
+    div   bool                           // y is a divisor, see divByZero
+    any   func(x, y value) (value, bool) // logical operations take any values
+    float func(x, y float64) float64     // see float.go
+    safe  func(x, y float64) float64     // protected float, if it differs from float
+    test  func(x, y float64) bool        // comparison of floats
+}
+
+func bigBool(b bool) *big.Int {
+    if b {
+        return big.NewInt(1)
+    }
+    return new(big.Int)
+}
+
+func bigDiv(x, y *big.Int) *big.Int {
+    if y.Sign() == 0 {
+        return new(big.Int)
+    }
+    return x.Quo(x, y)   // truncated as / on ints
+}
+
+var opAdd = mathOp{int: myAdd, big: func(x, y *big.Int) *big.Int {return x.Add(x, y)},
+                   float: func(x, y float64) float64 {return x + y}}
+var opSub = mathOp{int: mySub, big: func(x, y *big.Int) *big.Int {return x.Sub(x, y)},
+                   float: func(x, y float64) float64 {return x - y}}
+var opMul = mathOp{int: myMul, big: func(x, y *big.Int) *big.Int {return x.Mul(x, y)},
+                   float: func(x, y float64) float64 {return x * y}}
+var opDiv = mathOp{int: myDiv, big: bigDiv, div: true,
+                   float: func(x, y float64) float64 {return x / y}}
+var opGt  = mathOp{int: myGt, big: func(x, y *big.Int) *big.Int {return bigBool(x.Cmp(y) > 0)},
+                   test: func(x, y float64) bool {return x > y}}
+var opLt  = mathOp{int: myLt, big: func(x, y *big.Int) *big.Int {return bigBool(x.Cmp(y) < 0)},
+                   test: func(x, y float64) bool {return x < y}}
+
+// op applied to x and y, ok is false if one of them is no number
+// or the result is too large for the arena
+// does not run the gc, see reserveBig
+func (vm *Vm) arith(op mathOp, x, y value) (value, bool) {
+    if op.any != nil {
+        return op.any(x, y)
+    }
+    if !isNumber(x) || !isNumber(y) {
+        return nill, false
+    }
+    if isFloat(x) || isFloat(y) || op.int == nil {
+        return vm.floatArith(op, x, y)
+    }
+    if op.div && y == boxInt(0) {
+        return vm.divByZero(x)
+    }
+    if isInt(x) && isInt(y) {
+        if r, ok := op.int(unbox(x), unbox(y)); ok {
+            return boxInt(r), true
+        }
+    }
+    if op.words != nil && blockCells(op.words(vm, x, y)) > len(vm.arena) {
+        return nill, false
+    }
+    return vm.newBig(op.big(vm.bigOf(x), vm.bigOf(y))), true
+}
@@ -4,26 +4,30 @@
 package main
 
 import (
-    //"errors"
+    "errors"
     "fmt"
     "math/rand"
-    "os"
+    "sort"
+    "time"
 )
 
-const cells = 24*1024*1024
+const cells = 24*1024*1024   // default size of the arena
 //const cells = 1024*1024
-const gcMargin  = cells - 24
+const gcReserve = 24   // cells kept free for allocations between two gc checks
 const stackSize = 1024*1024
 
 // Tagbits (from right  to left)
-// three bits are used (from Bit 1 to Bit 3), Bit 4 is free and can be used for gc for tree traversals
-// local pointer, global pointer, Int, Prim, Symbol, Float
-// global pointers not used yet, will become meta gene pool of gene bracket
-// Bit 1 = 0 ->  Cell
-//    Bit 2 = 0 --> pointer to cell on local heap
-//    Bit 2 = 1 --> pointer to cell on global heap  (not used in the moment)
-//    Bit 3 = 0 --> cons (ie, list or quotation)
-//    Bit 3 = 1 --> closure
+// three bits are used (from Bit 1 to Bit 3), Bit 4 is used only for blocks
+// pointer to a list cell, pointer to a boxed value, Int, Prim, Symbol, Float
+// Bit 1 = 0 ->  pointer into the arena
+//    Bit 2 = 0 --> list cell
+//       Bit 3 = 0 --> cons (ie, list or quotation)
+//       Bit 3 = 1 --> closure
+//    Bit 2 = 1 --> value built from cells, opaque to list primitives
+//       Bit 3 = 0 --> map
+//       Bit 3 = 1 --> block of cells copied as a whole by the gc
+//          Bit 4 = 0 --> vector
+//          Bit 4 = 1 --> big int, the int is too large for a value
 // Bit 1 = 1 ->  Number or Symb
 // Bit 2 = 0 --> Symb
 //    Bit 3 = 0 --> assignable symbol
@@ -33,10 +37,13 @@ const stackSize = 1024*1024
 //    Bit 3 = 1 --> Float
 
 const tagType    = 7  // mask with bits 111
-const tagGlobal  = 2  // bits 010    cell on global heap
-const tagCell    = 1  // bits 001
-const tagCons    = 5  // bits 101
+const tagMask    = 15 // mask with all four bits
+const tagPtr     = 1  // bits 001    zero for all pointers
+const tagCell    = 3  // bits 011    zero for list cells
 const tagClosure = 4  // bits 100
+const tagMap     = 2  // bits 010
+const tagVec     = 6  // bits 0110
+const tagBig     = 14 // bits 1110
 const tagPrim    = 5  // bits 101
 const tagSymb    = 1  // bits 001
 const tagNumb    = 2  // bits 010
@@ -47,16 +54,18 @@ type value int
 
 func boxCons(x int) value {return value(x<<4) }   // create a new local cons
 func boxClosure(x int) value {return value(x<<4 | tagClosure)}   // create a new local closure
-//func boxGlobal(x int) value {return value(x<<4 | tagGlobal)}
+func boxMap(x int) value {return value(x<<4 | tagMap)}
+func boxVec(x int) value {return value(x<<4 | tagVec)}
+func boxBig(x int) value {return value(x<<4 | tagBig)}
 func boxPrim(x int) value {return value(x<<4 | tagPrim)}  // create a local primitive
 func boxSymb(x int) value {return value(x<<4 | tagSymb)}
 func boxInt(x int)  value {return value(x<<4 | tagInt)}
 
-// floats not yet interpreted
-//func box_float(x Int) Int { Int(reinterpret(Int32,x)) << 32 | tagFloat
-//func unbox_float(x value) float = reinterpret(Float32, Int32(x>>32))
+// floats are boxed in float.go
 
 func unbox(x value) int  {return int(x)>>4}   // remove all tags
+const maxInt = 1<<59 - 1   // largest int that fits into a value
+const minInt = -1<<59
 // in contrast to C, here the pointer is
 // just the heap index, that is, a number
 //func ptr(x value) int    {return int(x)>>4}   
@@ -65,14 +74,17 @@ func isInt(x value)    bool {return (x & tagType == tagInt)}
 func isFloat(x value)  bool {return (x & tagType == tagFloat)}
 func isPrim(x value)   bool {return (x & tagType == tagPrim)}
 func isSymb(x value)   bool {return (x & tagType == tagSymb)}
-func isLocal(x value)  bool {return (x & tagGlobal == 0)}
-func isGlobal(x value) bool {return (x & tagGlobal == tagGlobal)}
+func isPtr(x value)    bool {return (x & tagPtr == 0)}   // the gc follows these
 func isCell(x value)   bool {return (x & tagCell == 0)}
-func isAtom(x value)   bool {return (x & tagCell == tagCell)}
+func isAtom(x value)   bool {return (x & tagCell != 0)}
 //func isAtom(x value)  bool {return !isCell(x)}
-func isCons(x value)   bool {return (x & tagCons == 0)}
-func isClosure(x value) bool {return (x & tagCons == tagClosure)}
-func isNumb(x value)  bool {return (x & tagNumb) == tagNumb}
+func isCons(x value)   bool {return (x & tagType == 0)}
+func isClosure(x value) bool {return (x & tagType == tagClosure)}
+func isMap(x value)    bool {return (x & tagType == tagMap)}
+func isVec(x value)    bool {return (x & tagMask == tagVec)}
+func isBig(x value)    bool {return (x & tagMask == tagBig)}
+func isBlock(x value)  bool {return (x & tagType == tagVec)}   // vector or big int
+func isNumb(x value)  bool {return (x & tagInt) == tagInt}   // int or float
 func isAbstractSymb(x value) bool {return (x & tagNumb) == 0}  // symbol or primitive
 
 func isNil(x value) bool {return x == nill}
@@ -103,6 +115,7 @@ const (  // bracket primitives
         rec
         def
         lambda
+        argdef   // binds the arguments of a closure, shown as def but not read, see fLambda
         add
         sub
         mul
@@ -118,6 +131,51 @@ const (  // bracket primitives
         trace
         typ
         print
+        gcstat
+        reverse
+        concat
+        size
+        nth
+        take
+        dropn
+        last
+        mapp   // "mapp" since "map" already taken by golang
+        each
+        reduce
+        filter
+        assoc
+        get
+        dissoc
+        keys
+        has
+        setnth
+        slice
+        mod
+        neg
+        abs
+        minimum   // "minimum" since min is a builtin of golang
+        maximum
+        pow
+        sqrt
+        ge
+        le
+        ne
+        bitand
+        bitor
+        bitxor
+        shift
+        not
+        and
+        or
+        sin
+        cos
+        tan
+        atan
+        tanh
+        exp
+        log
+        toFloat
+        toInt
         unbound
 )
         //rto
@@ -128,10 +186,19 @@ const (  // bracket primitives
 
 var primStr = map[value] string {
     cons:"cons", car:"car", cdr:"cdr", def:"def", dip:"dip", dup:"dup", drop:"drop", 
-    esc:"esc", eval:"eval", eq:"eq", iff:"if",  lambda:"\\",
+    esc:"esc", eval:"eval", eq:"eq", iff:"if",  lambda:"\\", argdef:"def",
     rec:"rec", swap:"swap", val:"val", vesc:"vesc", 
     add:"+", sub:"-", mul:"*", div:"/", gt:">", lt:"<",rnd:"rnd",
-    rot:"rot", trace:"trace", typ:"typ", print:"print",
+    rot:"rot", trace:"trace", typ:"typ", print:"print", gcstat:"gcstat",
+    reverse:"reverse", concat:"concat", size:"size", nth:"nth", take:"take",
+    dropn:"drop-n", last:"last", mapp:"map", each:"each", reduce:"reduce",
+    filter:"filter", assoc:"assoc", get:"get", dissoc:"dissoc", keys:"keys",
+    has:"has", setnth:"set-nth", slice:"slice",
+    mod:"mod", neg:"neg", abs:"abs", minimum:"minimum", maximum:"maximum", pow:"pow",
+    sqrt:"sqrt", ge:"ge", le:"le", ne:"ne", bitand:"bit-and", bitor:"bit-or",
+    bitxor:"bit-xor", shift:"shift", not:"bool-not", and:"bool-and", or:"bool-or",
+    sin:"sin", cos:"cos", tan:"tan", atan:"atan", tanh:"tanh", exp:"exp-e",
+    log:"log-e", toFloat:"to-float", toInt:"to-int",
 }
 //cond:"cond",set:"set",dip:"dip",whl:"whl",
 //rto:"toR", tor:"Rto", 
@@ -142,11 +209,46 @@ var str2prim = map[string] value {
     "rec":rec,  "swap":swap, "val":val, "vesc":vesc, 
     "add":add, "+":add, "sub":sub, "-":sub, "*":mul, "mul":mul, "/":div, "div":div,
     "gt":gt, ">":gt, "lt":lt, "<":lt, "rnd":rnd,
-    "rot":rot,"trace":trace,"typ":typ,"print":print,
+    "rot":rot,"trace":trace,"typ":typ,"print":print,"gcstat":gcstat,
+    "reverse":reverse, "concat":concat, "size":size, "nth":nth, "take":take,
+    "drop-n":dropn, "last":last, "map":mapp, "each":each, "reduce":reduce,
+    "filter":filter, "assoc":assoc, "get":get, "dissoc":dissoc, "keys":keys,
+    "has":has, "set-nth":setnth, "slice":slice, "len":size,
+    "mod":mod, "neg":neg, "abs":abs, "minimum":minimum, "maximum":maximum, "pow":pow,
+    "sqrt":sqrt, "ge":ge, "le":le, "ne":ne, "bit-and":bitand, "bit-or":bitor,
+    "bit-xor":bitxor, "shift":shift, "bool-not":not, "bool-and":and, "bool-or":or,
+    "sin":sin, "cos":cos, "tan":tan, "atan":atan, "tanh":tanh, "exp-e":exp,
+    "log-e":log, "to-float":toFloat, "to-int":toInt,
 }
 //"cond":cond,"set":set,"dip":dip,"whl":whl,
 //"toR":tor, "Rto":rto,
 
+// random number generator of the vm (xorshift64*)
+// we keep our own generator instead of the global one of math/rand,
+// so that its state can be saved and restored with a snapshot
+type rng struct {
+    state uint64
+}
+
+func (r *rng) seed(s int64) {
+    r.state = uint64(s)
+    if r.state == 0 {   // xorshift must not start from zero
+        r.state = 0x9E3779B97F4A7C15
+    }
+}
+
+func (r *rng) next() uint64 {
+    r.state ^= r.state >> 12
+    r.state ^= r.state << 25
+    r.state ^= r.state >> 27
+    return r.state * 2685821657736338717
+}
+
+// random number in [0,n), n must be positive
+func (r *rng) intn(n int) int {
+    return int(r.next() % uint64(n))
+}
+
 type stats struct { // some statistics about the running program
     nInst   int   // number of Instructions
     nRecur  int   // recursion depth
@@ -162,31 +264,118 @@ type Vm struct {
     next int      // index to next entry on arena
     arena []cell  // memory arena to hold the cells
     brena []cell  // second arena, needed for copying gc
+    vecs  []value // vector region, see vector.go
+    bvecs []value // second vector region, for the copying gc
+    vecNext int   // index to the next free value in vecs
+    vecLimit int  // gc is needed when vecNext passes this index
+    vecOld int    // vectors below vecOld are older than the last gc
     stack []value  //
     stackIndex int
     needGc bool   // flag to indicate that heap space gets rare
     depth int     // current recursion depth
     stats stats   // some statistics about the running program
     trace int     //trace mode e: 0=no trace, 1=trace non-verbose, 3=verbose
+    rng rng       // random number generator used by rnd
+    hashCons bool // share structurally identical cons cells
+    consTable map[cell]value  // hash-consing table, rebuilt during gc
+    youngHashed []int  // hash-consed cells allocated since the last gc
+    gcMargin int  // a full gc is needed when next passes this index
+    gcLimit int   // gc is needed when next passes this index
+    generational bool // use a nursery for young cells
+    nursery int   // size of the nursery in cells
+    oldTop int    // cells below oldTop are in old space
+    remembered []int  // old cells which point into the nursery
+    gcStats GCStats   // statistics about garbage collection
+    gcQuiet bool  // do not print a banner at each full gc
+    roots []*value    // Go variables registered as gc roots by protect
+    err error     // error which halted the evaluation
+    maxSteps int  // evaluation halts after this many steps, 0 = no limit
+    calls    int  // nesting of primitives that call back into evalBra
+    userPrims map[value]userPrim  // primitives registered with RegisterPrim
+    userCodes map[string]value    // names of registered primitives
+    primSet *PrimSet  // primitives code may use, nil allows all
+    libMark value     // or-ed to the primitives read, libPrim while reading the prelude
+    division Division // result of a division by zero
+    ieee bool     // floats may be Inf and NaN, see float.go
+    problem interface{}  // state of the GP problem, made by its Setup
+}
+
+// statistics about garbage collection, useful to tune arena sizes
+// and to detect programs which bloat memory
+type GCStats struct {
+    Collections int   // number of all collections
+    Minor       int   // number of nursery collections
+    Major       int   // number of full collections
+    CellsCopied int   // cells copied by all collections
+    Promoted    int   // cells promoted from nursery to old space
+    LiveCells   int   // cells in use after the last collection
+    PeakCells   int   // highest number of cells in use before a collection
+    Time        time.Duration  // time spent in gc
+}
+
+func (vm *Vm) GCStats() GCStats {
+    return vm.gcStats
+}
+
+// book-keeping at start and end of every collection
+func (vm *Vm) gcStart() time.Time {
+    if vm.next+1 > vm.gcStats.PeakCells {
+        vm.gcStats.PeakCells = vm.next+1
+    }
+    return time.Now()
+}
 
+func (vm *Vm) gcEnd(start time.Time, copied, live int) {
+    vm.gcStats.Collections += 1
+    vm.gcStats.CellsCopied += copied
+    vm.gcStats.LiveCells = live
+    vm.gcStats.Time += time.Since(start)
 }
 
 func init_vm() Vm {
-    a := make([]cell, cells)
-    b := make([]cell, cells)
-    stack := make([]value, stackSize)
-    stats := stats{0,0,0,0}
-    vm := Vm{nill,nill,nill,-1,a,b,stack,-1,false,0,stats,0}
-    vm.env = vm.cons(nill,nill)
+    return newVm(cells)
+}
+
+// vm with an arena of n cells, and a vector region of n/4 values
+func newVm(n int) Vm {
+    return vmOn(make([]cell, n), make([]cell, n), make([]value, n/4), make([]value, n/4),
+        make([]value, stackSize))
+}
+
+// new vm on the memory of vm, nothing else is kept, vm must not be used
+// any more. This saves allocating and clearing large arenas again
+func (vm *Vm) recycle() Vm {
+    return vmOn(vm.arena, vm.brena, vm.vecs, vm.bvecs, vm.stack)
+}
+
+func vmOn(a, b []cell, va, vb []value, stack []value) Vm {
+    n := len(a)
+    vm := Vm{bra:nill, ket:nill, env:nill, next:-1, arena:a, brena:b,
+             vecs:va, bvecs:vb, vecLimit:len(va) - len(va)/4,
+             stack:stack, stackIndex:-1, gcMargin:n - gcReserve, gcLimit:n - gcReserve}
+    vm.rng.seed(rand.Int63())
+    vm.env = vm.mcons(nill,nill)
     return vm 
 }
 
 func (vm *Vm) reset() {
     vm.next = -1
+    vm.vecNext = 0
+    vm.vecOld = 0
     vm.stats = stats{0,0,0,0}
     vm.bra = nill
     vm.ket = nill
-    vm.env = vm.cons(nill,nill)
+    vm.env = vm.mcons(nill,nill)
+    if vm.hashCons {
+        vm.consTable = make(map[cell]value)
+    }
+    vm.youngHashed = nil
+    vm.unprotect(0)
+    vm.err = nil
+    vm.oldTop = 0
+    vm.remembered = vm.remembered[:0]
+    vm.gcStats = GCStats{}
+    vm.setGcLimit()
     vm.stackIndex = -1
     vm.depth = 0
     vm.trace = 0
@@ -196,79 +385,346 @@ func (vm *Vm) reset() {
 //  garbage collector  *********************************
 //  implement Cheney copying algorithm
 //    Cheney :  non-recursive traversal of live-objects
-func (vm *Vm) relocate(c value) value {
+//  optionally generational: young cells are allocated in a nursery
+//  on top of old space, and a minor gc copies only the survivors of
+//  the nursery, which are then promoted to old space. Old cells point
+//  to younger cells only through setcar/setcdr, these are recorded
+//  by a write barrier in the remembered set.
+
+// choose between a minor and a full collection
+// a minor gc is done only if old space has room for the whole nursery,
+// and the vector region, which only a full gc compacts, has room left
+func (vm *Vm) gc() {
+    if vm.generational && vm.next + vm.nursery < vm.gcMargin && vm.vecNext <= vm.vecLimit {
+        vm.minorGc()
+    } else {
+        vm.fullGc()
+    }
+}
+
+// switch generational gc on with a nursery of n cells, n=0 switches off
+// all cells allocated so far are regarded as old
+func (vm *Vm) setGenerational(n int) {
+    vm.generational = n > 0
+    vm.nursery = n
+    vm.oldTop = vm.next + 1
+    vm.remembered = vm.remembered[:0]
+    vm.setGcLimit()
+}
+
+func (vm *Vm) setGcLimit() {
+    vm.gcLimit = vm.gcMargin
+    if vm.generational && vm.oldTop + vm.nursery < vm.gcMargin {
+        vm.gcLimit = vm.oldTop + vm.nursery
+    }
+}
+func (vm *Vm) relocate(c value, hashed *[]int) value {
    var c1 value
-   if !isCell(c) {
+   if !isPtr(c) {
        return c
    }
+   if isVec(c) {
+       return vm.relocateVec(c)
+   }
    indb := unbox(c)   // index into brena
    bcell := vm.brena[indb]
    if bcell.car == unbound {
        return bcell.cdr
    }
    inda := vm.next    // index into arena
-   if isCons(c) {
-     c1 = boxCons(inda)
-   } else {
-     c1 = boxClosure(inda)
+   c1 = value(inda<<4) | c & tagMask
+   if vm.hashCons && isCons(c) && vm.consTable[bcell] == c {  // remember hash-consed cells
+      *hashed = append(*hashed, inda)
    }
    //vm.arena[ind]   = vm.brena[indv]
-   vm.arena[inda]  = bcell
+   n := 1
+   if isBlock(c) {   // the elements follow the header
+      n = blockCells(unbox(bcell.car))
+   }
+   copy(vm.arena[inda:inda+n], vm.brena[indb:indb+n])
    vm.brena[indb] = cell{unbound, c1}
-   vm.next += 1
+   vm.next += n
    return c1
 }
 
-func (vm *Vm) gc() {
-   fmt.Println("starting gc ************************************************")
+// copy a live vector into the new vector region, the header of the
+// old block is replaced by the new vector, which marks it as copied
+func (vm *Vm) relocateVec(c value) value {
+   i := unbox(c)
+   if h := vm.bvecs[i]; isVec(h) {
+       return h
+   }
+   n := unbox(vm.bvecs[i]) + 1
+   c1 := boxVec(vm.vecNext)
+   copy(vm.vecs[vm.vecNext:vm.vecNext+n], vm.bvecs[i:i+n])
+   vm.bvecs[i] = c1
+   vm.vecNext += n
+   return c1
+}
+
+func (vm *Vm) fullGc() {
+   if !vm.gcQuiet {
+       fmt.Println("starting gc ************************************************")
+   }
+   start := vm.gcStart()
    var c cell
+   var hashed []int   // new indices of hash-consed cells
    vm.brena, vm.arena = vm.arena, vm.brena
+   vm.bvecs, vm.vecs = vm.vecs, vm.bvecs
    finger :=  0
+   vfinger := 0
    vm.next = 0
+   vm.vecNext = 0
 
    // scan root of every live object
-   vm.bra = vm.relocate(vm.bra)
-   vm.ket = vm.relocate(vm.ket)
-   vm.env = vm.relocate(vm.env)
+   vm.bra = vm.relocate(vm.bra, &hashed)
+   vm.ket = vm.relocate(vm.ket, &hashed)
+   vm.env = vm.relocate(vm.env, &hashed)
    for i:=0; i<=vm.stackIndex; i++ { 
-     vm.stack[i] = vm.relocate(vm.stack[i])
+     vm.stack[i] = vm.relocate(vm.stack[i], &hashed)
+   }
+   for _, r := range vm.roots {
+     *r = vm.relocate(*r, &hashed)
    }
 
-   // scan remaining objects in arena (including objects added by this loop)
-   for finger < vm.next {
-      c = vm.arena[finger]
-      rcar := vm.relocate(c.car)
-      rcdr := vm.relocate(c.cdr)
-      vm.arena[finger] = cell{rcar,rcdr}
-      //vm.arena[finger] = cell{vm.relocate(c.car), vm.relocate(c.cdr)}
-      finger += 1
+   // scan remaining objects in arena and in the vector region
+   // (including objects added by this loop)
+   for finger < vm.next || vfinger < vm.vecNext {
+      for finger < vm.next {
+         c = vm.arena[finger]
+         rcar := vm.relocate(c.car, &hashed)
+         rcdr := vm.relocate(c.cdr, &hashed)
+         vm.arena[finger] = cell{rcar,rcdr}
+         //vm.arena[finger] = cell{vm.relocate(c.car), vm.relocate(c.cdr)}
+         finger += 1
+      }
+      for vfinger < vm.vecNext {   // the elements of a copied vector
+         n := unbox(vm.vecs[vfinger])
+         for i := vfinger+1; i <= vfinger+n; i++ {
+            vm.vecs[i] = vm.relocate(vm.vecs[i], &hashed)
+         }
+         vfinger += n + 1
+      }
   }
 
+   // cells have moved, so the hash-consing table is built anew
+   // only from the surviving cells (dead entries are dropped)
+   if vm.hashCons {
+       vm.consTable = make(map[cell]value, len(hashed))
+       for _, i := range hashed {
+           vm.consTable[vm.arena[i]] = boxCons(i)
+       }
+       vm.youngHashed = vm.youngHashed[:0]
+   }
+
    //fmt.Println("GC: live objects found: ", vm.next-1)
    //fmt.Println("stack ", vm.stackIndex, " ", vm.depth)
-   if vm.next >= gcMargin {
-       fmt.Println("Bracket GC, arena too small")
-        panic("Vm stack overflow")
+   if vm.next >= vm.gcMargin || vm.vecNext > vm.vecLimit {   // live cells fill the arena
+       vm.halt(vmError("arena too small"))
    }
+   vm.oldTop = vm.next    // all survivors are old now
+   vm.vecOld = vm.vecNext
+   vm.remembered = vm.remembered[:0]
+   vm.setGcLimit()
+   vm.gcStats.Major += 1
+   vm.gcEnd(start, vm.next, vm.next)
    vm.needGc = false
    //fmt.Println("GC finished")
 }
 
+// copy a live cell of the nursery into brena, at the index it
+// will have in old space, and leave a forwarding cell in arena
+func (vm *Vm) relocateYoung(c value, to *int, hashed *[]int) value {
+   if !isPtr(c) || isVec(c) || unbox(c) < vm.oldTop {   // vectors stay in place
+       return c
+   }
+   ind := unbox(c)
+   acell := vm.arena[ind]
+   if acell.car == unbound {
+       return acell.cdr
+   }
+   c1 := value(*to<<4) | c & tagMask
+   if vm.hashCons && isCons(c) && vm.consTable[acell] == c {
+       delete(vm.consTable, acell)  // entered again after the gc
+       *hashed = append(*hashed, *to)
+   }
+   n := 1
+   if isBlock(c) {
+       n = blockCells(unbox(acell.car))
+   }
+   copy(vm.brena[*to:*to+n], vm.arena[ind:ind+n])
+   vm.arena[ind] = cell{unbound, c1}
+   *to += n
+   return c1
+}
+
+func (vm *Vm) minorGc() {
+   start := vm.gcStart()
+   var c cell
+   var hashed []int
+   top := vm.oldTop
+   to := top
+
+   // roots are the registers, the stack and the remembered old cells
+   vm.bra = vm.relocateYoung(vm.bra, &to, &hashed)
+   vm.ket = vm.relocateYoung(vm.ket, &to, &hashed)
+   vm.env = vm.relocateYoung(vm.env, &to, &hashed)
+   for i:=0; i<=vm.stackIndex; i++ {
+     vm.stack[i] = vm.relocateYoung(vm.stack[i], &to, &hashed)
+   }
+   for _, r := range vm.roots {
+     *r = vm.relocateYoung(*r, &to, &hashed)
+   }
+   // a cell may be remembered more than once, but must be relocated
+   // only once, since new indices look like indices into the nursery
+   sort.Ints(vm.remembered)
+   for k, i := range vm.remembered {
+      if k > 0 && vm.remembered[k-1] == i {
+          continue
+      }
+      c = vm.arena[i]
+      rcar := vm.relocateYoung(c.car, &to, &hashed)
+      rcdr := vm.relocateYoung(c.cdr, &to, &hashed)
+      vm.arena[i] = cell{rcar,rcdr}
+   }
+   // vectors made since the last gc may hold young cells, older ones not,
+   // since vectors are never changed
+   for i := vm.vecOld; i < vm.vecNext; i += unbox(vm.vecs[i]) + 1 {
+      for j := i+1; j <= i+unbox(vm.vecs[i]); j++ {
+         vm.vecs[j] = vm.relocateYoung(vm.vecs[j], &to, &hashed)
+      }
+   }
+
+   // scan the copied cells
+   for finger := top; finger < to; finger++ {
+      c = vm.brena[finger]
+      rcar := vm.relocateYoung(c.car, &to, &hashed)
+      rcdr := vm.relocateYoung(c.cdr, &to, &hashed)
+      vm.brena[finger] = cell{rcar,rcdr}
+   }
+
+   if vm.hashCons {
+       for _, i := range vm.youngHashed {  // drop dead entries
+           if vm.arena[i].car != unbound {
+               delete(vm.consTable, vm.arena[i])
+           }
+       }
+       vm.youngHashed = vm.youngHashed[:0]
+   }
+
+   // survivors are promoted: move them behind old space
+   copy(vm.arena[top:to], vm.brena[top:to])
+   if vm.hashCons {
+       for _, i := range hashed {
+           vm.consTable[vm.arena[i]] = boxCons(i)
+       }
+   }
+   vm.gcStats.Minor += 1
+   vm.gcStats.Promoted += to - top
+   vm.oldTop = to
+   vm.vecOld = vm.vecNext
+   vm.next = to - 1
+   vm.remembered = vm.remembered[:0]
+   vm.setGcLimit()
+   vm.gcEnd(start, to - top, to)
+   vm.needGc = false
+}
+
+
+// rooting of Go variables  *********************
+// a primitive that allocates in a loop must keep its intermediate
+// values alive and up to date across a gc. It registers the addresses
+// of its variables as roots and releases them when done:
+//
+//     defer vm.unprotect(vm.protect(&list, &acc))
+//     for ... {
+//         acc = vm.cons(x, acc)
+//         vm.maybeGc()
+//     }
+//
+// the gc relocates the registered variables in place
+
+// register variables as gc roots, returns a mark for unprotect
+func (vm *Vm) protect(ps ...*value) int {
+    mark := len(vm.roots)
+    vm.roots = append(vm.roots, ps...)
+    return mark
+}
+
+// release all roots registered since mark
+func (vm *Vm) unprotect(mark int) {
+    for i := mark; i < len(vm.roots); i++ {
+        vm.roots[i] = nil
+    }
+    vm.roots = vm.roots[:mark]
+}
+
+// collect garbage if the arena is getting full
+// only safe if all live values are reachable from the roots
+func (vm *Vm) maybeGc() {
+    if vm.needGc {
+        vm.gc()
+    }
+}
+
+// run the gc now if the next n cells would go over its limit, so that
+// n cells can be allocated without gc checks, e.g. for assoc of a map
+// the values of the caller must be protected
+func (vm *Vm) reserve(n int) {
+    if vm.next + n > vm.gcLimit {
+        vm.needGc = true
+        vm.maybeGc()
+    }
+}
+
 // **********************
 
 func (vm *Vm) makeCons(pcar, pcdr value) int {
    vm.next += 1
-   if vm.next > gcMargin {
+   if vm.next > vm.gcLimit {
      vm.needGc = true
+     if vm.next == len(vm.arena) {
+         vm.next--
+         panic(vmError("arena exhausted"))
+     }
    }
    vm.arena[vm.next] = cell{pcar,pcdr}
    return vm.next  // return index
 }
 
+// with hash-consing, structurally identical cells share one cell
 func (vm *Vm) cons(pcar, pcdr value) value {
+    if !vm.hashCons {
+        return boxCons(vm.makeCons(pcar,pcdr))
+    }
+    c := cell{pcar,pcdr}
+    if p, ok := vm.consTable[c]; ok {
+        return p
+    }
+    i := vm.makeCons(pcar,pcdr)
+    p := boxCons(i)
+    vm.consTable[c] = p
+    vm.youngHashed = append(vm.youngHashed, i)
+    return p
+}
+
+// mutable cons, never shared by hash-consing
+// must be used for all cells later changed by setcar or setcdr
+func (vm *Vm) mcons(pcar, pcdr value) value {
     return boxCons(vm.makeCons(pcar,pcdr))
 }
 
+// switch hash-consing on or off
+// cells allocated before hash-consing was switched on are not shared
+func (vm *Vm) setHashCons(on bool) {
+    vm.hashCons = on
+    if on {
+        vm.consTable = make(map[cell]value)
+    } else {
+        vm.consTable = nil
+    }
+}
+
 func (vm *Vm) closure(pcar, pcdr value) value {
     return boxClosure(vm.makeCons(pcar,pcdr))
 }
@@ -279,12 +735,20 @@ func (vm *Vm) stripClosure(cl *value) {
     } 
 }
 
+// remember old cells that get a pointer into the nursery
+func (vm *Vm) writeBarrier(ind int, p value) {
+    if vm.generational && ind < vm.oldTop && isPtr(p) && unbox(p) >= vm.oldTop {
+        vm.remembered = append(vm.remembered, ind)
+    }
+}
+
 // ------- careful that we do not leak mutablilty
 //         should be used only for environments
 // modify car or cdr of a cell without allocating a new cell
 // should only be used for bindings
 func (vm *Vm) setcar(cl value, newcar value) {
     ind := unbox(cl)
+    vm.writeBarrier(ind, newcar)
     vm.arena[ind].car = newcar 
     //pcdr := vm.arena[ind].cdr
     //vm.arena[ind] = cell{newcar, pcdr} 
@@ -292,6 +756,7 @@ func (vm *Vm) setcar(cl value, newcar value) {
 
 func (vm *Vm) setcdr(cl value, newcdr value) {
     ind := unbox(cl)
+    vm.writeBarrier(ind, newcdr)
     vm.arena[ind].cdr = newcdr 
     //pcar := vm.arena[ind].car
     //vm.arena[ind] = cell{pcar, newcdr} 
@@ -390,15 +855,10 @@ func (vm *Vm) lengthNonQuoted(list value) int {
 func (vm *Vm) reverse(list value) (value, bool) {
     var p value 
     l := nill
+    defer vm.unprotect(vm.protect(&list, &l))
     for vm.popCons(&list,&p) { // take care not to pop from a closure
         l = vm.cons(p,l)
-        if vm.needGc {
-            vm.pushStack(l)
-            vm.pushStack(list)
-            vm.gc()
-            list = vm.popStack()
-            l = vm.popStack()
-        }
+        vm.maybeGc()
     }
     if isClosure(list) { //take only quotation from closure, not the env
        l = vm.cons(vm.car(list), l)
@@ -414,9 +874,20 @@ func (vm *Vm) reverse(list value) (value, bool) {
 func (vm *Vm) isEqual(p1, p2 value) bool {
    vm.stripClosure(&p1)
    vm.stripClosure(&p2)
+   if p1 == p2 {   // identical cells, always the case for hash-consed data
+      return true
+   }
    if isCell(p1) && isCell(p2) { 
       return (vm.isEqual(vm.car(p1),vm.car(p2)) && 
               vm.isEqual(vm.cdr(p1),vm.cdr(p2)))
+   } else if isPrim(p1) && isPrim(p2) {   // also primitives of the prelude
+       return shownPrim(p1) == shownPrim(p2)
+   } else if isMap(p1) && isMap(p2) {
+       return vm.mapEqual(p1, p2)
+   } else if isVec(p1) && isVec(p2) {
+       return vm.vecEqual(p1, p2)
+   } else if isBig(p1) && isBig(p2) {
+       return vm.bigOf(p1).Cmp(vm.bigOf(p2)) == 0
    } else { 
        return (p1 == p2)
    }
@@ -424,8 +895,8 @@ func (vm *Vm) isEqual(p1, p2 value) bool {
 
 // stack functions  ---------------------------
 func (vm *Vm) pushStack(x value) {
-    if vm.stackIndex == stackSize {
-        panic("Vm stack overflow")
+    if vm.stackIndex == len(vm.stack)-1 {
+        panic(vmError("stack overflow"))
     }
     vm.stackIndex++;
     vm.stack[vm.stackIndex] = x
@@ -464,7 +935,7 @@ func (vm *Vm) printStack() {
 
 // creates new empty environment
 func (vm *Vm) newEnv(env value) value {
-    return vm.cons(nill,env)
+    return vm.mcons(nill,env)
 }
 
 // ----------- bindings -----------------------------------
@@ -512,7 +983,7 @@ func (vm *Vm) bindKey(key,val value) {
     env := vm.env
     bnd := vm.findLocalKey(key,env)
     if isNil(bnd) { // key does not yet exist
-        bnd = vm.cons(key,val)
+        bnd = vm.mcons(key,val)
         vm.setcar(env, vm.cons(bnd, vm.car(env)) )
     } else { // key exists, just override val
         vm.setcdr(bnd, val)
@@ -525,7 +996,7 @@ func (vm *Vm) setKey(key,val value) {
     env := vm.env
     bnd := vm.findKey(key)
     if isNil(bnd) { // key does not yet exist
-        bnd = vm.cons(key,val)
+        bnd = vm.mcons(key,val)
         vm.setcar(env, vm.cons(bnd, vm.car(env)) )
     } else { // key exists, just override val
         vm.setcdr(bnd, val)
@@ -547,6 +1018,9 @@ func istrue(x value) bool {
 */
 
 func istrue(x value) bool {
+    if isFloat(x) {
+        return unboxFloat(x) != 0
+    }
     return x != nill && unbox(x) != 0
 }
 
@@ -626,36 +1100,39 @@ func (vm *Vm) fCdr() {
     }
 }
 
-type mathIntFunc func(int, int) int
-func myAdd(x,y int) int {return x+y}
-func mySub(x,y int) int {return x-y}
-func myMul(x,y int) int {return x*y}
-func myDiv(x,y int) int {
+// ok is false if the result does not fit into a value, see bigint.go
+type mathIntFunc func(int, int) (int, bool)
+func myAdd(x,y int) (int, bool) {return x+y, fits(x+y)}
+func mySub(x,y int) (int, bool) {return x-y, fits(x-y)}
+func myMul(x,y int) (int, bool) {
+    r := x*y
+    return r, x == 0 || r/x == y && fits(r)   // r/x != y if r overflowed
+}
+func myDiv(x,y int) (int, bool) {
     if y==0 {
-        return 0
+        return 0, true
     } else {
-       return x/y
+       return x/y, fits(x/y)
     }
 }
 
-func myGt(x,y int) int {
+func myGt(x,y int) (int, bool) {
    if x>y {
-       return 1
+       return 1, true
    } else  {
-       return 0
+       return 0, true
    }
 }
-func myLt(x,y int) int {
+func myLt(x,y int) (int, bool) {
    if y>x {
-       return 1
+       return 1, true
    } else  {
-       return 0
+       return 0, true
    }
 }
 
-// a bit spagetti, but doing the job
-func (vm *Vm) fMath(op mathIntFunc) {
-    var c1, c2, n1, n2 value
+func (vm *Vm) fMath(op mathOp) {
+    var n1, n2 value
     if vm.pop2(&vm.ket, &n1, &n2) {
       if isSymb(n1) {
           n1 = vm.boundvalue(n1) 
@@ -663,95 +1140,104 @@ func (vm *Vm) fMath(op mathIntFunc) {
       if isSymb(n2) {
           n2 = vm.boundvalue(n2) 
       }
-      if isNumb(n1) && isNumb(n2) {
-          vm.ket = vm.cons(boxInt(op(unbox(n1), unbox(n2))),vm.ket)
-      } else if isCell(n1) && isCell(n2) {
-          vm.stripClosure(&n1)
-          vm.stripClosure(&n2)
-          c := nill
-          for vm.pop(&n1,&c1) && vm.pop(&n2,&c2) {
-             if isSymb(c1) {
-                    c1 = vm.boundvalue(c1) 
-             }
-             if isSymb(c2) {
-                    c2 = vm.boundvalue(c2) 
-             }
-             if isNumb(c1) && isNumb(c2) {
-                 c = vm.cons(boxInt(op(unbox(c1), unbox(c2))) ,c)
-             }
-             if vm.needGc {
-                  vm.pushStack(c)
-                  vm.pushStack(n1)
-                  vm.pushStack(n2)
-                  vm.gc()
-                  n2 = vm.popStack()
-                  n1 = vm.popStack()
-                  c = vm.popStack()
-             }
-          }
-          c,_ = vm.reverse(c)
-          vm.ket = vm.cons(c,vm.ket)
-      } else if isCell(n1) {
-          vm.stripClosure(&n1)
-          c := nill
-          for vm.pop(&n1,&c1) {
-             if isSymb(c1) {
-                    c1 = vm.boundvalue(c1) 
-             }
-             if isNumb(c1) && isNumb(n2) {
-                 c = vm.cons(boxInt(op(unbox(c1), unbox(n2))) ,c)
-             }
-              if vm.needGc {
-                  vm.pushStack(c)
-                  vm.pushStack(n1)
-                  vm.gc()
-                  n1 = vm.popStack()
-                  c = vm.popStack()
-              }
-          }
-          c,_ = vm.reverse(c)
-          vm.ket = vm.cons(c,vm.ket)
-      } else if isCell(n2) {
-          vm.stripClosure(&n2)
-          c := nill
-          for vm.pop(&n2,&c2) {
-             if isSymb(c2) {
-                    c2 = vm.boundvalue(c2) 
-             }
-             if isNumb(n1) && isNumb(c2) {
-                 c = vm.cons(boxInt(op(unbox(n1), unbox(c2))) ,c)
-             }
-              if vm.needGc {
-                  vm.pushStack(c)
-                  vm.pushStack(n2)
-                  vm.gc()
-                  n2 = vm.popStack()
-                  c = vm.popStack()
-              }
-          }
-          c,_ = vm.reverse(c)
-          vm.ket = vm.cons(c,vm.ket)
-      }
+      vm.math(op, n1, n2)
   }
 }
+
+// push op applied to n1 and n2, elementwise if one is a list or vector
+func (vm *Vm) math(op mathOp, n1, n2 value) {
+    if isVec(n1) || isVec(n2) {
+        vm.listAsVec(&n1, &n2)
+        vm.listAsVec(&n2, &n1)
+        if v, ok := vm.mathVec(op, n1, n2); ok {
+            vm.ket = vm.cons(v, vm.ket)
+        }
+    } else if isCell(n1) || isCell(n2) {
+        vm.ket = vm.cons(vm.mathList(op, n1, n2), vm.ket)
+    } else {
+        vm.reserveBig(op, &n1, &n2)
+        if r, ok := vm.arith(op, n1, n2); ok {
+            vm.ket = vm.cons(r,vm.ket)
+        }
+    }
+}
+
+// apply op elementwise, if one of n1, n2 is a list
+// a bit spagetti, but doing the job
+func (vm *Vm) mathList(op mathOp, n1, n2 value) value {
+    var c1, c2 value
+    c := nill
+    defer vm.unprotect(vm.protect(&n1, &n2, &c, &c1, &c2))
+    if isCell(n1) && isCell(n2) {
+        vm.stripClosure(&n1)
+        vm.stripClosure(&n2)
+        for vm.pop(&n1,&c1) && vm.pop(&n2,&c2) {
+           if isSymb(c1) {
+                  c1 = vm.boundvalue(c1) 
+           }
+           if isSymb(c2) {
+                  c2 = vm.boundvalue(c2) 
+           }
+           vm.reserveBig(op, &c1, &c2)
+           if r, ok := vm.arith(op, c1, c2); ok {
+               c = vm.cons(r ,c)
+           }
+           vm.maybeGc()
+        }
+    } else if isCell(n1) {
+        vm.stripClosure(&n1)
+        for vm.pop(&n1,&c1) {
+           if isSymb(c1) {
+                  c1 = vm.boundvalue(c1) 
+           }
+           vm.reserveBig(op, &c1, &n2)
+           if r, ok := vm.arith(op, c1, n2); ok {
+               c = vm.cons(r ,c)
+           }
+           vm.maybeGc()
+        }
+    } else {
+        vm.stripClosure(&n2)
+        for vm.pop(&n2,&c2) {
+           if isSymb(c2) {
+                  c2 = vm.boundvalue(c2) 
+           }
+           vm.reserveBig(op, &n1, &c2)
+           if r, ok := vm.arith(op, n1, c2); ok {
+               c = vm.cons(r ,c)
+           }
+           vm.maybeGc()
+        }
+    }
+    c,_ = vm.reverse(c)
+    return c
+}
+
 func (vm *Vm) fRnd() {
     var p value
     if vm.pop(&vm.ket, &p) {
         if isInt(p) {  // random number from 1 to p
             p1 := unbox(p)
             if p1 > 0 {
-              p = boxInt(rand.Intn(p1)+1)
+              p = boxInt(vm.rng.intn(p1)+1)
             } else {
               p = boxInt(0)
             }
+        } else if isFloat(p) {   // random float from 0 up to p
+            p = vm.rndFloat(unboxFloat(p))
+        } else if isVec(p) {   // in constant time
+            if n := vm.vecLen(p); n > 0 {
+                p = vm.vecAt(p, vm.rng.intn(n))
+            }
         } else if isCell(p) {
             vm.stripClosure(&p)
-            n := vm.length(p)
-            n1 := rand.Intn(n)
-            for i:=0; i<n1; i++ {
-                p = vm.cdr(p)
+            if n := vm.length(p); n > 0 {   // empty code of a closure gives []
+                n1 := vm.rng.intn(n)
+                for i:=0; i<n1; i++ {
+                    p = vm.cdr(p)
+                }
+                p = vm.car(p)
             }
-            p = vm.car(p)
         }
         vm.ket = vm.cons(p, vm.ket)
     }
@@ -822,12 +1308,253 @@ func (vm *Vm) fTrace() { // change trace mode
     }
 }
 
+// list primitives ---------------------------
+// elements are counted from the head of a list, i.e. from the
+// element car returns. A symbol stands for the list bound to it,
+// arguments that are no lists are consumed and nothing is pushed
+
+func (vm *Vm) listArg(p *value) bool {
+    if isSymb(*p) {
+        *p = vm.boundvalue(*p)
+    }
+    vm.stripClosure(p)
+    return isCons(*p) || isNil(*p)
+}
+
+// cons the first n elements of l (all if n < 0) in reverse order onto tail
+// the gc may run in between, values of the caller must be protected
+func (vm *Vm) revAppend(l, tail value, n int) value {
+    var p value
+    defer vm.unprotect(vm.protect(&l, &tail))
+    for ; n != 0 && vm.popCons(&l, &p); n-- {
+        tail = vm.cons(p, tail)
+        vm.maybeGc()
+    }
+    return tail
+}
+
+// pop an int n and a list from the ket
+func (vm *Vm) popIndex(n *int, l *value) bool {
+    var p value
+    if vm.pop2(&vm.ket, &p, l) && isInt(p) && vm.listArg(l) {
+        *n = unbox(p)
+        return true
+    }
+    return false
+}
+
+func (vm *Vm) fReverse() {
+    var l value
+    if vm.pop(&vm.ket, &l) && vm.listArg(&l) {
+        l = vm.revAppend(l, nill, -1)
+        vm.ket = vm.cons(l, vm.ket)
+    }
+}
+
+// concat [1 2] [3 4] gives [1 2 3 4]
+// the cells of the second list are copied, the first list is shared
+func (vm *Vm) fConcat() {
+    var l1, l2 value
+    if vm.pop2(&vm.ket, &l1, &l2) && vm.listArg(&l1) && vm.listArg(&l2) {
+        mark := vm.protect(&l1)
+        l2 = vm.revAppend(vm.revAppend(l2, nill, -1), l1, -1)
+        vm.unprotect(mark)
+        vm.ket = vm.cons(l2, vm.ket)
+    }
+}
+
+// size of a list or a vector, or the number of entries of a map
+func (vm *Vm) fSize() {
+    var l value
+    if vm.pop(&vm.ket, &l) {
+        switch {
+        case vm.listArg(&l):
+            vm.ket = vm.cons(boxInt(vm.length(l)), vm.ket)
+        case isMap(l):
+            vm.ket = vm.cons(boxInt(vm.mapCount(l)), vm.ket)
+        case isVec(l):
+            vm.ket = vm.cons(boxInt(vm.vecLen(l)), vm.ket)
+        }
+    }
+}
+
+// nth 0 l is car l, nothing is pushed if l is too short
+// nth 0 #[a b] is a, vectors are indexed in constant time
+func (vm *Vm) fNth() {
+    var l, p value
+    if !vm.pop2(&vm.ket, &p, &l) || !isInt(p) {
+        return
+    }
+    n := unbox(p)
+    switch {
+    case vm.vecArg(&l):
+        if n >= 0 && n < vm.vecLen(l) {
+            vm.ket = vm.cons(vm.vecAt(l, n), vm.ket)
+        }
+    case vm.listArg(&l) && n >= 0:
+        for ; n >= 0 && vm.popCons(&l, &p); n-- {
+        }
+        if n < 0 {
+            vm.ket = vm.cons(p, vm.ket)
+        }
+    }
+}
+
+// the first n elements of a list
+func (vm *Vm) fTake() {
+    var n int
+    var l value
+    if vm.popIndex(&n, &l) {
+        if n < 0 {
+            n = 0
+        }
+        l = vm.revAppend(vm.revAppend(l, nill, n), nill, -1)
+        vm.ket = vm.cons(l, vm.ket)
+    }
+}
+
+// the list without the first n elements
+func (vm *Vm) fDropn() {
+    var n int
+    var l, p value
+    if vm.popIndex(&n, &l) {
+        for ; n > 0 && vm.popCons(&l, &p); n-- {
+        }
+        if !isCons(l) {   // also the tail of a dotted list
+            l = nill
+        }
+        vm.ket = vm.cons(l, vm.ket)
+    }
+}
+
+// the last element, the one farthest from the head
+func (vm *Vm) fLast() {
+    var l value
+    if vm.pop(&vm.ket, &l) && vm.listArg(&l) && isCons(l) {
+        for isCons(vm.cdr(l)) {
+            l = vm.cdr(l)
+        }
+        vm.ket = vm.cons(vm.car(l), vm.ket)
+    }
+}
+
+// higher-order list primitives  -----------
+// the function is called for each element from the head of the list,
+// with the element on top of the ket, in a new scope as by eval.
+// The evaluator is entered again for each call, so all values the
+// primitive holds must be protected from the gc
+
+const maxCalls = 10000
+
+// evaluate f with the current ket, f is a quotation, a closure
+// or a single word
+func (vm *Vm) call(f value) {
+    if isNil(f) {   // the empty quotation
+        return
+    }
+    if vm.calls == maxCalls {   // each call also nests on the Go stack
+        panic(vmError("calls nested too deep"))
+    }
+    vm.calls++
+    defer func() {vm.calls--}()
+    bra, env := vm.bra, vm.env
+    defer vm.unprotect(vm.protect(&f, &bra, &env))
+    switch {
+    case isClosure(f):
+        vm.env = vm.newEnv(vm.cdr(f))
+        vm.bra = vm.car(f)
+    case isCons(f):
+        vm.env = vm.newEnv(vm.env)
+        vm.bra = f
+    default:
+        vm.env = vm.newEnv(vm.env)
+        vm.bra = vm.cons(f, nill)
+    }
+    vm.evalBra()
+    vm.bra, vm.env = bra, env
+}
+
+// pop a function and a list from the ket
+func (vm *Vm) popFunc(f, l *value) bool {
+    return vm.pop2(&vm.ket, f, l) && vm.listArg(l)
+}
+
+// apply f to each element and take the top of the ket as result,
+// ok is false if f left no result
+func (vm *Vm) apply(f, x value) (value, bool) {
+    k := vm.ket
+    defer vm.unprotect(vm.protect(&k))
+    vm.ket = vm.cons(x, vm.ket)
+    vm.call(f)
+    if vm.ket == k || !isCell(vm.ket) {
+        return nill, false
+    }
+    r := vm.car(vm.ket)
+    vm.ket = vm.cdr(vm.ket)
+    return r, true
+}
+
+// each f [1 2 3] evaluates f on 3, 2 and 1, the results stay on the ket
+func (vm *Vm) fEach() {
+    var f, l, x value
+    if vm.popFunc(&f, &l) {
+        defer vm.unprotect(vm.protect(&f, &l))
+        for vm.err == nil && vm.popCons(&l, &x) {
+            vm.ket = vm.cons(x, vm.ket)
+            vm.call(f)
+        }
+    }
+}
+
+// reduce f init list, e.g. reduce [+] 0 [1 2 3] gives 6
+func (vm *Vm) fReduce() {
+    var f, init, l, x value
+    if vm.pop(&vm.ket, &f) && vm.pop2(&vm.ket, &init, &l) && vm.listArg(&l) {
+        defer vm.unprotect(vm.protect(&f, &l))
+        vm.ket = vm.cons(init, vm.ket)
+        for vm.err == nil && vm.popCons(&l, &x) {
+            vm.ket = vm.cons(x, vm.ket)
+            vm.call(f)
+        }
+    }
+}
+
+// map [* dup] [1 2 3] gives [1 4 9]
+func (vm *Vm) fMap() {
+    var f, l, x value
+    r := nill
+    if vm.popFunc(&f, &l) {
+        defer vm.unprotect(vm.protect(&f, &l, &r, &x))
+        for vm.err == nil && vm.popCons(&l, &x) {
+            if y, ok := vm.apply(f, x); ok {
+                r = vm.cons(y, r)
+            }
+        }
+        vm.ket = vm.cons(vm.revAppend(r, nill, -1), vm.ket)
+    }
+}
+
+// filter [gt swap 0] [1 -2 3] keeps the elements for which f gives true
+func (vm *Vm) fFilter() {
+    var f, l, x value
+    r := nill
+    if vm.popFunc(&f, &l) {
+        defer vm.unprotect(vm.protect(&f, &l, &r, &x))
+        for vm.err == nil && vm.popCons(&l, &x) {
+            if t, ok := vm.apply(f, x); ok && istrue(t) {
+                r = vm.cons(x, r)
+            }
+        }
+        vm.ket = vm.cons(vm.revAppend(r, nill, -1), vm.ket)
+    }
+}
+
 func (vm *Vm) fTyp() { // type of an element
     var p value
     var t int
     if vm.pop(&vm.ket,&p) {
         switch {
-        case isInt(p):
+        case isInteger(p):
             t=1
         case isPrim(p):
             t=2
@@ -837,6 +1564,12 @@ func (vm *Vm) fTyp() { // type of an element
             t=4
         case isClosure(p):
             t=5
+        case isMap(p):
+            t=6
+        case isVec(p):
+            t=7
+        case isFloat(p):
+            t=8
         default:
             t=0
         }
@@ -852,6 +1585,17 @@ func (vm *Vm) fPrint() {
     }
 }
 
+func (vm *Vm) fGcstat() {
+// push [collections copied live peak microseconds] of gc statistics
+    st := vm.gcStats
+    l := nill
+    for _, n := range []int{st.Collections, st.CellsCopied, st.LiveCells,
+                            st.PeakCells, int(st.Time.Microseconds())} {
+        l = vm.cons(boxInt(n), l)
+    }
+    vm.ket = vm.cons(l, vm.ket)
+}
+
 func (vm *Vm) fRec() {
 //anonymous recursion: replace bra of this scope by original value
     var b value
@@ -862,7 +1606,9 @@ func (vm *Vm) fRec() {
     }
 }
 
-func (vm *Vm) fLambda() {
+// the arguments are bound by argdef in front of the code, which runs
+// wherever lambda may run, lib is true for the lambda of the prelude
+func (vm *Vm) fLambda(lib bool) {
    var clos,quote,keys value
    if vm.pop2(&vm.ket, &keys, &quote) {
        if isAtom(quote) {
@@ -871,7 +1617,11 @@ func (vm *Vm) fLambda() {
        switch {
        case isCons(quote):   // make a new closure
           if isDef(keys) {                 // if arguments are not nill ..
-               quote = vm.cons(def, quote)  // .. push a definition on quote
+               bind := argdef
+               if lib {
+                   bind |= libPrim
+               }
+               quote = vm.cons(bind, quote)  // .. push a definition on quote
                quote = vm.cons(keys, quote)
                if isAtom(keys) {
                    quote = vm.cons(esc, quote)
@@ -920,18 +1670,13 @@ func (vm *Vm) deepBind(keys, val value) {
     //vm.printElem(keys); fmt.Println()
     //vm.printElem(val); fmt.Println()
     var key value
+    defer vm.unprotect(vm.protect(&keys))
     for vm.pop(&keys,&key) {
         if isAtom(key) {
             vm.bindKey(key,val)
-            if vm.needGc {
-                vm.pushStack(keys)
-                vm.gc()
-                keys = vm.popStack()
-            }
+            vm.maybeGc()
         } else {  // key itself is a list
-            vm.pushStack(keys)
             vm.deepBind(key, val)
-            keys = vm.popStack()
         }
     }
 } 
@@ -979,15 +1724,15 @@ func (vm *Vm) fDef() {
            for i:=0; i<n1; i++ {  // make the bindings
                vm.pop(&key, &k) 
                // Q: do need to check that key is still a list in the line below??
-               if k == vesc && vm.pop(&key, &k){  // this is interpreted as set
+               if plainPrim(k) == vesc && vm.pop(&key, &k){  // this is interpreted as set
                   vm.setKey(k,vm.popStack())
                } else if isAtom(k) {
                   vm.bindKey(k,vm.popStack())
                } else {
                   elem := vm.popStack()
-                  vm.pushStack(key)  // safe key in case of gc
+                  mark := vm.protect(&key)  // safe key in case of gc
                   vm.match(k,elem)
-                  key = vm.popStack()
+                  vm.unprotect(mark)
                }
            }
        }
@@ -1073,6 +1818,14 @@ func (vm *Vm) evalSymb(sym value) {
 }
 
 func (vm *Vm) evalPrim(p value) {
+    lib := p & libPrim != 0
+    p = plainPrim(p)
+    if !lib && vm.primSet != nil && !vm.primSet.has(p) {
+        if vm.primSet.Strict {
+            vm.halt(fmt.Errorf("primitive %s not in set %s", vm.primName(p), vm.primSet.Name))
+        }
+        return
+    }
     switch p { 
     case dup:
         vm.fDup()
@@ -1094,26 +1847,78 @@ func (vm *Vm) evalPrim(p value) {
         vm.fDip()
     case rec:
         vm.fRec()
-    case def:
+    case def, argdef:
         vm.fDef()
     //case set:
     //    vm.fSet()
     case lambda:
-        vm.fLambda()
+        vm.fLambda(lib)
     //case whl:
     //    vm.fWhl()
     case add:
-        vm.fMath(myAdd)
+        vm.fMath(opAdd)
     case sub:
-        vm.fMath(mySub)
+        vm.fMath(opSub)
     case mul:
-        vm.fMath(myMul)
+        vm.fMath(opMul)
     case div:
-        vm.fMath(myDiv)
+        vm.fMath(opDiv)
     case gt:
-        vm.fMath(myGt)
+        vm.fMath(opGt)
     case lt:
-        vm.fMath(myLt)
+        vm.fMath(opLt)
+    case mod:
+        vm.fMath(opMod)
+    case neg:
+        vm.fMath1(opNeg)
+    case abs:
+        vm.fMath1(opAbs)
+    case minimum:
+        vm.fMath(opMin)
+    case maximum:
+        vm.fMath(opMax)
+    case pow:
+        vm.fMath(opPow)
+    case sqrt:
+        vm.fMath1(opSqrt)
+    case ge:
+        vm.fMath(opGe)
+    case le:
+        vm.fMath(opLe)
+    case ne:
+        vm.fNe()
+    case bitand:
+        vm.fMath(opBitAnd)
+    case bitor:
+        vm.fMath(opBitOr)
+    case bitxor:
+        vm.fMath(opBitXor)
+    case shift:
+        vm.fMath(opShift)
+    case not:
+        vm.fMath1(opNot)
+    case and:
+        vm.fMath(opAnd)
+    case or:
+        vm.fMath(opOr)
+    case sin:
+        vm.fMath1(opSin)
+    case cos:
+        vm.fMath1(opCos)
+    case tan:
+        vm.fMath1(opTan)
+    case atan:
+        vm.fMath1(opAtan)
+    case tanh:
+        vm.fMath1(opTanh)
+    case exp:
+        vm.fMath1(opExp)
+    case log:
+        vm.fMath1(opLog)
+    case toFloat:
+        vm.fMath1(opFloat)
+    case toInt:
+        vm.fMath1(opInt)
     case rnd:
         vm.fRnd()
     case eq:
@@ -1134,7 +1939,49 @@ func (vm *Vm) evalPrim(p value) {
         vm.fTyp()
     case print:
         vm.fPrint()
+    case gcstat:
+        vm.fGcstat()
+    case reverse:
+        vm.fReverse()
+    case concat:
+        vm.fConcat()
+    case size:
+        vm.fSize()
+    case nth:
+        vm.fNth()
+    case take:
+        vm.fTake()
+    case dropn:
+        vm.fDropn()
+    case last:
+        vm.fLast()
+    case mapp:
+        vm.fMap()
+    case each:
+        vm.fEach()
+    case reduce:
+        vm.fReduce()
+    case filter:
+        vm.fFilter()
+    case assoc:
+        vm.fAssoc()
+    case get:
+        vm.fGet()
+    case dissoc:
+        vm.fDissoc()
+    case keys:
+        vm.fKeys()
+    case has:
+        vm.fHas()
+    case setnth:
+        vm.fSetnth()
+    case slice:
+        vm.fSlice()
     default:
+        if up, ok := vm.userPrims[p]; ok {
+            vm.evalUserPrim(up)
+            return
+        }
         fmt.Println("Error: unknown primitive")
         vm.printElem(p); fmt.Println()
         
@@ -1142,11 +1989,32 @@ func (vm *Vm) evalPrim(p value) {
 }
 
 
+// evaluate the bra until it is empty or an error halts the vm
 func (vm *Vm) evalBra() {
       //fmt.Println("Start eval ")
       // Q: should we check for isAtom(vm.bra) ??
     startingDepth := vm.depth
+    startingEnv := vm.env
+    startingIndex := vm.stackIndex
+    defer vm.unprotect(vm.protect(&startingEnv))   // restored on a halt, the gc moves it
+    if startingIndex == -1 {   // new evaluation, not called by a primitive
+        vm.stats.nSteps = 0
+        vm.err = nil
+    }
     vm.pushStack(vm.bra)
+    defer func() {   // fatal errors of the vm halt the evaluation
+        if r := recover(); r != nil {
+            err, ok := r.(vmError)
+            if !ok {
+                panic(r)
+            }
+            vm.halt(err)
+            vm.stackIndex = startingIndex + 1
+            vm.depth = startingDepth
+            vm.env = startingEnv
+            vm.bra = vm.popStack()
+        }
+    }()
     var e value
     for {
         if vm.trace > 0 { 
@@ -1173,6 +2041,16 @@ func (vm *Vm) evalBra() {
         if vm.needGc {
             vm.gc()
         }
+        vm.stats.nSteps++
+        if vm.maxSteps > 0 && vm.stats.nSteps >= vm.maxSteps {
+            vm.halt(errors.New("step budget exhausted"))
+        }
+        if vm.err != nil {   // halt, drop all scopes entered here
+            vm.stackIndex = startingIndex + 1
+            vm.depth = startingDepth
+            vm.env = startingEnv
+            break
+        }
         if isAtom(vm.bra) {    // exit scope
             if vm.depth == startingDepth {
               break
@@ -1186,63 +2064,6 @@ func (vm *Vm) evalBra() {
     vm.bra = vm.popStack()
 }
 
-func main() {
-    fmt.Printf("rock'n roll\n")   
-    vm := init_vm()
-    
-    // load prelude
-    vm.bra = vm.loadFile("prelude.clj")
-    vm.evalBra()
-
-
-    //prog := "whl [gt 0 dup add 1] 1 -50000000"  // 5e7, 3 sec on Mac
- 
-    
-    //prog := "eval [ rec gt 0 dup add 1 ] -5 trace 1"
-    //prog := "eval [rec gt 0 dup add 1 dup] -5 trace 0"
-    //prog := "1 \\' 10  "
-    //prog := "eval [ rec gt 0 dup add 1 ] -50000000"   // 5e7, 3.9 sec on MAc
-    //prog := "eval [ rec gt 0 dup add 1 ] -500000000"   // 5e8, 24.9 sec on MAc
-    
-    /*prog := "ack 3 10 def ack' \\[m n]"+
-    "[cond "+
-    "  [ [ack - m 1 ack m - n 1]"+
-    "    [ack - m 1 1]  [eq 0 n]"+
-    "    [+ n 1]  [eq 0 m]] ]"
-*/
-
-   /* prog := "ack 3 8 def ack' "+
-    "[cond "+
-    "  [ [ack - m 1 ack m - n 1]"+
-    "    [ack - m 1 1]  [eq 0 n]"+
-    "    [+ n 1]  [eq 0 m]] def [m n]]"
-
-*/
-
-    //prog := "drop2 1 2 3"
-    //prog := "if 0 20"
-
-    //prog := "fac 4 def fac' [eval if rot [1 drop] [* fac - swap 1 dup] eq 1 dup]"
-    //prog := "+ [2 1 7] [4 8]"
-    //prog := "rot 1"
-    prog := "rot 1"
-
-    if len(os.Args) == 2 {
-        vm.bra = vm.loadFile(os.Args[1])
-    } else {
-       vm.bra = vm.makeBra(prog)
-    }
-
-    vm.printBra(vm.bra)
-    
-    vm.evalBra()
-    //fmt.Println(vm.bra)
-
-    vm.printKet(vm.ket)
-
-}
-
-
 /* todos
 
  - defining the symbol ket, creates a new local ket in 
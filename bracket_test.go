@@ -1,12 +1,22 @@
 package main
 
 import (
+       "bytes"
+       "encoding/gob"
+       "errors"
        "fmt"
+       "io/ioutil"
+       "math"
+       "math/big"
+       "os"
+       "path/filepath"
+       "strconv"
+       "strings"
        "testing"
    )
 
 // generate a closure to safe test statistics
-func (vm *Vm) makeTest() (f func(string, string)){
+func (vm *Vm) makeTest(t *testing.T) (f func(string, string)){
   var ntests, success int
   f = func(code, res string){
       if code == "__show results__" {
@@ -16,14 +26,11 @@ func (vm *Vm) makeTest() (f func(string, string)){
       } else {
           ntests++
           vm.reset()
-          // load prelude
-          vm.bra = vm.loadFile("prelude.clj")
-          vm.evalBra()
-
+          vm.loadPrelude(preludeSrc)
           vm.bra = vm.makeBra(code)
-          vm.ket = nill
-          result,_ := vm.reverse(vm.makeBra(res))
           vm.evalBra()
+          // build result only now, it is not protected from the gc
+          result,_ := vm.reverse(vm.makeBra(res))
           if vm.isEqual(vm.ket, result) {
             //fmt.Println("test no error")
             //vm.printKet(vm.makeBra(code))
@@ -32,11 +39,7 @@ func (vm *Vm) makeTest() (f func(string, string)){
               success++
               return 
           } else {
-            //t.Error() 
-            fmt.Println("test error")
-            vm.printKet(vm.makeBra(code))
-            vm.printKet(vm.ket)
-            vm.printKet(result)
+            t.Errorf("%s: got %s, want %s", code, vm.ketString(vm.ket), res)
             return 
           }
      }
@@ -47,7 +50,7 @@ func (vm *Vm) makeTest() (f func(string, string)){
 func TestBracket(t *testing.T) {
   vm := init_vm()
   //var c, r string
-  test := vm.makeTest() 
+  test := vm.makeTest(t) 
 
   test("1 2 3",     "1 2 3")   // values on bra are shifted on ket
   test("1 2 3; this is a comment",    "1 2 3")
@@ -350,7 +353,6 @@ func TestBracket(t *testing.T) {
   test("when1 0 [+ 10]","")
   test("unless 1 [+ 10] 20","20")
   test("unless 0 [+ 10] 20","30")
-  //test("reverse [1 2 3]","[3 2 1]")
 
   test("caar [6 [4 5][1 2 3]", "3")
   test("cadr [6 [4 5][1 2 3]", "[4 5]")
@@ -371,18 +373,47 @@ func TestBracket(t *testing.T) {
   test("cleave2 [[-][*][+]] 3 4","-1 12 7")
 
   test("each [* dup] [4 3 2 1]", "16 9 4 1")
-  test("map [* dup] [4 3 2 1]", "[1 4 9 16]") // reverse still missing
+  test("map [* dup] [4 3 2 1]", "[16 9 4 1]")
   test("unstack [4 3 2 1]", "4 3 2 1")
 
   test("sum [2 5 10]", "17")
   test("prod [2 5 10]", "100")
   test("size [2 5 foo [3 4] 10]", "5")
   test("repeat 4 [+ 2] 0", "8")
-  test("filter [gt swap 0] [2 -1 5]", "[5 2]")  // reverse still missing
+  test("filter [gt swap 0] [2 -1 5]", "[2 5]")
   test("filter [gt swap 0] [-2 -1 -10]", "[]")
   test("drop drop loop [lt 0 dup - swap 1 keep [*]] 4 1", "24")
 
-  //test("reverse [1 2 3]","[3 2 1]")
+  test("append [1 2] [3 4]", "[1 2 3 4]")
+
+  // native list primitives, counting from the head (car)
+  test("reverse [1 2 3]", "[3 2 1]")
+  test("reverse []", "[]")
+  test("concat [1 2] [3 [4]]", "[1 2 3 [4]]")
+  test("concat [] [1]", "[1]")
+  test("size [1 [2 3] 4]", "3")
+  test("size l def l' [1 2]", "2")
+  test("nth 0 [1 2 3] nth 2 [1 2 3]", "3 1")
+  test("nth 3 [1 2 3] nth -1 [1]", "")
+  test("take 2 [1 2 3 4] take 9 [1]", "[3 4] [1]")
+  test("drop-n 2 [1 2 3 4] drop-n 9 [1]", "[1 2] []")
+  test("last [1 2 3] last []", "1")
+  test("reverse 5 size x'", "0")   // unbound x is []
+
+  // higher-order primitives call back into the evaluator
+  test("map [* dup] [1 2 3]", "[1 4 9]")
+  test("map [+ 1] [] each [+ 1] []", "[]")
+  test("map dup' [1 2]", "[1 2] 1 2")   // the top is the result
+  test("map [drop] [1 2] 5", "[] 5")
+  test("map [map [* 2]] [[1 2] [3]]", "[[2 4] [6]]")
+  test("map sq' [1 2] def sq' [* dup]", "[1 4]")
+  test("map add1' [1 2] def add1' eval \\[x] [\\[][+ x]] 1", "[2 3]")   // closure
+  test("map [x def x' + 1] [1 2] x def x' 0", "[2 3] 0")   // def is local to the call
+  test("each [* 10] [1 2]", "10 20")
+  test("reduce [cons] [] [1 2 3]", "[3 2 1]")
+  test("reduce [+] 0 x'", "0")
+  test("filter [gt 3] [1 2 3 4 5]", "[1 2]")
+  test("filter [eq 2] [1 2 3 2]", "[2 2]")
  
 
   // small examples, to give a feeling for the language
@@ -494,3 +525,1163 @@ func TestBracket(t *testing.T) {
   test("__show results__", "")
 }
 
+
+func TestSnapshot(t *testing.T) {
+  vm := init_vm()
+  fname := t.TempDir() + "/vm.snap"
+  // ints on the ket, top first
+  ints := func() (l []int) {
+      for k := vm.ket; isCell(k); k = vm.cdr(k) {
+          l = append(l, unbox(vm.car(k)))
+      }
+      return
+  }
+
+  vm.bra = vm.makeBra("def sq' [* dup] 3 4")
+  vm.evalBra()
+  if err := vm.Snapshot(fname); err != nil {
+      t.Fatal(err)
+  }
+  vm.bra = vm.makeBra("sq rnd 1000 rnd 1000")
+  vm.evalBra()
+  want := fmt.Sprint(ints())
+
+  vm.reset()
+  vm.bra = vm.makeBra("def sq' [] 1 2")
+  vm.evalBra()
+  if err := vm.Restore(fname); err != nil {
+      t.Fatal(err)
+  }
+  // bindings, ket and random numbers continue as before the restore
+  vm.bra = vm.makeBra("sq rnd 1000 rnd 1000")
+  vm.evalBra()
+  if got := fmt.Sprint(ints()); got != want {
+      t.Error("restored vm gives", got, "instead of", want)
+  }
+}
+
+// the settings of the vm are restored as well
+func TestSnapshotSettings(t *testing.T) {
+  vm := newVm(1<<16)
+  fname := t.TempDir() + "/vm.snap"
+  vm.setHashCons(true)
+  vm.setGenerational(500)
+  vm.UsePrimSet("arith")
+  vm.primSet.Strict = true
+  vm.maxSteps = 1000
+  vm.SetDivision("one")
+  vm.SetIEEE(true)
+  if err := vm.Snapshot(fname); err != nil {
+      t.Fatal(err)
+  }
+  other := newVm(1<<16)
+  if err := other.Restore(fname); err != nil {
+      t.Fatal(err)
+  }
+  if !other.hashCons {
+      t.Error("hash-consing not restored")
+  }
+  if !other.generational || other.nursery != 500 {
+      t.Error("nursery not restored", other.nursery)
+  }
+  if ps := other.primSet; ps == nil || ps.Name != "arith" || !ps.Strict || !ps.has(dup) || ps.has(cons) {
+      t.Error("primitive set not restored", ps)
+  }
+  if other.maxSteps != 1000 {
+      t.Error("step budget not restored", other.maxSteps)
+  }
+  if other.division != DivOne {
+      t.Error("division not restored", other.division)
+  }
+  if !other.ieee {
+      t.Error("ieee floats not restored")
+  }
+  // registered primitives are not saved, they must be the same
+  nop := func(*Vm) error {return nil}
+  vm.RegisterPrim("beep", 0, nop)
+  if err := vm.Snapshot(fname); err != nil {
+      t.Fatal(err)
+  }
+  if other.Restore(fname) == nil {
+      t.Error("snapshot restored without its primitives")
+  }
+  other.RegisterPrim("beep", 0, nop)
+  if err := other.Restore(fname); err != nil {
+      t.Error(err)
+  }
+}
+
+// a corrupt snapshot is refused and leaves the vm unchanged
+func TestSnapshotCorrupt(t *testing.T) {
+  vm := init_vm()
+  vm.gcQuiet = true
+  fname := t.TempDir() + "/vm.snap"
+  vm.bra = vm.makeBra("#[1 2 3] 12345678901234567890 [1 [2]] def sq' [* dup]")
+  vm.evalBra()
+  if err := vm.Snapshot(fname); err != nil {
+      t.Fatal(err)
+  }
+  var good snapshot
+  f, _ := os.Open(fname)
+  gob.NewDecoder(f).Decode(&good)
+  f.Close()
+  for i, corrupt := range []func(s *snapshot){
+      func(s *snapshot) {s.Ket = boxCons(s.Next)},
+      func(s *snapshot) {s.Arena[1] = boxClosure(s.Next + 100)},
+      func(s *snapshot) {s.Arena[0] = value(8)},   // no tag
+      func(s *snapshot) {s.Stack = append(s.Stack, boxMap(-1))},
+      func(s *snapshot) {s.Env = boxInt(1)},
+      func(s *snapshot) {s.Bra = unbound},
+      func(s *snapshot) {s.Bra = firstUserPrim},   // not registered
+      func(s *snapshot) {   // a vector longer than the saved region
+          if len(s.Vecs) != 4 || s.Vecs[0] != boxInt(3) {
+              t.Error("no vector in the snapshot")
+          }
+          s.Vecs[0] = boxInt(4)
+      },
+      func(s *snapshot) {s.Bra = boxVec(1)},   // not the start of a vector
+  } {
+      s := good
+      s.Arena = append([]value{}, good.Arena...)
+      s.Vecs = append([]value{}, good.Vecs...)
+      corrupt(&s)
+      f, _ := os.Create(fname)
+      gob.NewEncoder(f).Encode(&s)
+      f.Close()
+      vm.reset()
+      vm.bra = vm.makeBra("1 2")
+      vm.evalBra()
+      if err := vm.Restore(fname); err == nil || vm.ketString(vm.ket) != "1 2" {
+          t.Error("corrupt snapshot", i, "restored, error", err)
+      }
+  }
+}
+
+func TestHashCons(t *testing.T) {
+  vm := init_vm()
+  vm.setHashCons(true)
+  test := vm.makeTest(t)
+  test("[1 2 [3]] [1 2 [3]]", "[1 2 [3]] [1 2 [3]]")
+  if a, b := vm.car(vm.ket), vm.car(vm.cdr(vm.ket)); a != b {
+      t.Error("identical quotations are not shared")
+  }
+  // bindings are mutable and must not be shared
+  test("x y def x' 1 eval [def y' 2]", "1 []")
+  test("a 2 a 3 def a' [make_adder 4] a 2 a 3 def a' [make_adder 5]"+
+       "def make_adder' [addx def x']"+
+       "def addx' [+ x z def z']" , "6 7 7 8")
+
+  // sharing survives a gc
+  vm.bra = vm.makeBra("[1 2 [3]]")
+  vm.evalBra()
+  vm.gc()
+  vm.bra = vm.makeBra("[1 2 [3]]")
+  vm.evalBra()
+  if a, b := vm.car(vm.ket), vm.car(vm.cdr(vm.ket)); a != b {
+      t.Error("identical quotations are not shared after gc")
+  }
+  test("__show results__", "")
+}
+
+func TestGenerationalGc(t *testing.T) {
+  vm := init_vm()
+  vm.gcQuiet = true
+  test := vm.makeTest(t)
+  for _, hash := range []bool{false, true} {
+    vm.setHashCons(hash)
+    vm.setGenerational(500)
+    test("ack 3 4 def ack' \\[m n]"+
+     " [eval if eq 0 m "+
+     "    [+ n 1]  "+
+     " [eval if eq 0 n "+
+     "     [ack - m 1 1]  "+
+     " [ack - m 1 ack m - n 1] ]] ", "125")
+    // bindings in old frames are changed by def, needs the write barrier
+    test("x foo foo def foo' [x def [x`] + 1 x`] def x' 10", "12 12 11")
+    test("acc withdraw' 60 "+
+    "acc deposit' 100 acc withdraw' 60 acc withdraw' 60 acc deposit' 40 "+
+    "def acc' make-acc 50 "+
+    "def make-acc' [ "+
+      "\\[m][eval if eq m withdraw' "+
+             "[withdraw] "+
+          "[eval if eq m deposit' "+
+             "[deposit] "+
+            " [unknown']]] "+
+     "def withdraw' [ "+
+         "eval if gt balance rot "+
+           "[balance def [balance`] - balance] "+
+           "[insuff' drop] dup ] "+
+     "def deposit' [balance def [balance`] + balance]"+
+     "def balance' ]", "70 130 insuff 30 90")
+    if vm.gcStats.Minor == 0 {
+        t.Error("no minor collection, hash-consing", hash)
+    }
+  }
+  test("typ gcstat", "4")
+  test("typ car gcstat", "1")
+  st := vm.GCStats()
+  if st.LiveCells == 0 || st.PeakCells < st.LiveCells || st.CellsCopied < st.Promoted {
+      t.Error("inconsistent gc statistics", st)
+  }
+  test("__show results__", "")
+}
+
+func TestProtect(t *testing.T) {
+  vm := init_vm()
+  vm.setGenerational(100)
+  test := vm.makeTest(t)
+  // gc happens inside the primitives
+  test("size + [1 2 3 4 5 6 7 8 9 10 11 12 13 14 15 16 17 18 19 20 "+
+       "21 22 23 24 25 26 27 28 29 30 31 32 33 34 35 36 37 38 39 40] 1", "40")
+  test("a` b` c` d` def [[a b [c d]]] 2", "2 2 2 2")
+  test("sum concat reverse take 30 l' l' def l' [1 2 3 4 5 6 7 8 9 10 11 12 13 14 15 16 "+
+       "17 18 19 20 21 22 23 24 25 26 27 28 29 30 31 32 33 34 35 36 37 38 39 40]", "1585")
+  test("sum map [* 2] filter [gt 20] l' def l' [1 2 3 4 5 6 7 8 9 10 11 12 13 14 15 16 "+
+       "17 18 19 20 21 22 23 24 25 26 27 28 29 30 31 32 33 34 35 36 37 38 39 40]", "380")
+  test("slice 2 4 v eq v set-nth 1 2 v' def v' reduce [+] #[1 2 3 4 5] l' "+
+       "def l' [1 2 3 4 5 6 7 8 9 10]", "#[58 59] 0")
+  test("size m eq m reduce [assoc dup] {} reverse l' def m' reduce [assoc dup] {} l' "+
+       "def l' [1 2 3 4 5 6 7 8 9 10 11 12 13 14 15 16 17 18 19 20 21 22 23 24 25 26 27 28 29 30]",
+       "30 1")
+
+  // build a long list from Go, with collections in between
+  l := nill
+  mark := vm.protect(&l)
+  for i := 0; i < 1000; i++ {
+      l = vm.cons(boxInt(i), l)
+      vm.maybeGc()
+  }
+  vm.unprotect(mark)
+  if vm.gcStats.Minor == 0 {
+      t.Error("no collection while building the list")
+  }
+  for i := 999; i >= 0; i-- {
+      if unbox(vm.car(l)) != i {
+          t.Fatal("list corrupted by gc at element", i)
+      }
+      l = vm.cdr(l)
+  }
+  test("__show results__", "")
+}
+
+func TestMap(t *testing.T) {
+  vm := newVm(1<<16)
+  vm.setGenerational(1000)
+  ref := map[int]int{}
+  m := vm.newMap(0, nill)
+  old := m   // persistent, never changes
+  defer vm.unprotect(vm.protect(&m, &old))
+  for i := 0; i < 3000; i++ {
+      k := vm.rng.intn(200)
+      vm.reserve(vm.mapNeed(m, boxInt(k)))
+      if i % 3 == 2 {
+          m = vm.mapDissoc(m, boxInt(k))
+          delete(ref, k)
+      } else {
+          m = vm.mapAssoc(m, boxInt(k), boxInt(i))
+          ref[k] = i
+      }
+      if i == 100 {
+          old = m
+          vm.ket = vm.cons(m, nill)
+      }
+  }
+  if vm.gcStats.Minor == 0 {
+      t.Error("no collection while building the map")
+  }
+  if vm.mapCount(m) != len(ref) {
+      t.Errorf("%d entries, want %d", vm.mapCount(m), len(ref))
+  }
+  for k := 0; k < 200; k++ {
+      v, ok := vm.mapGet(m, boxInt(k))
+      if i, in := ref[k]; ok != in || ok && unbox(v) != i {
+          t.Errorf("key %d: got %d %v, want %d %v", k, unbox(v), ok, i, in)
+      }
+  }
+  if !vm.isEqual(old, vm.car(vm.ket)) || vm.isEqual(old, m) {
+      t.Error("old version of the map changed")
+  }
+
+  // a bucket left alone moves up to the root
+  a, b, c := string2symbol("a"), string2symbol("b"), string2symbol("c")
+  m = vm.mapFromList(vm.makeBra("a 1 b 2 c 3 a 4"))
+  if v, _ := vm.mapGet(m, a); vm.mapCount(m) != 3 || unbox(v) != 4 {
+      t.Error("assoc of a key twice gives", vm.PrettyPrint(m, 80))
+  }
+  m = vm.mapDissoc(vm.mapDissoc(m, a), b)
+  if root := vm.mapRoot(m); !isCons(root) || vm.caar(root) != c {
+      t.Error("trie not collapsed after dissoc")
+  }
+}
+
+func TestVector(t *testing.T) {
+  for _, nursery := range []int{0, 500} {   // full and minor collections
+      vm := newVm(1<<14)
+      vm.gcQuiet = true
+      vm.setGenerational(nursery)
+      v := vm.vecFromList(vm.makeBra("[1] 2 [[3]] x"))
+      next := vm.next
+      if vm.newVec(make([]value, 10)); vm.next != next || vm.vecNext != 5 + 11 {
+          t.Error("vector not in the vector region")
+      }
+      mark := vm.protect(&v)
+      for i := 0; i < 5000; i++ {   // garbage, the blocks move
+          vm.reserveVec(i % 50)
+          vm.newVec(make([]value, i % 50))
+          vm.cons(boxInt(i), nill)
+      }
+      vm.unprotect(mark)
+      if vm.gcStats.Collections < 2 {
+          t.Error("no collection, nursery", nursery)
+      }
+      if out := vm.PrettyPrint(v, 80); out != "#[[1] 2 [[3]] x]" {
+          t.Error("vector after gc", out)
+      }
+      l := "[" + strings.Repeat("1 ", 300) + "]"
+      vm.bra = vm.makeBra("nth 2 reduce [+] #[1 2 3] " + l)
+      vm.evalBra()
+      if vm.ketString(vm.ket) != "303" {
+          t.Error("vector arithmetic with gc gives", vm.ketString(vm.ket))
+      }
+      vm.ket = nill
+      vm.bra = vm.makeBra("nth 299 + #" + l + " " + l)   // the list becomes a vector
+      vm.evalBra()
+      if vm.ketString(vm.ket) != "2" {
+          t.Error("vector and list arithmetic gives", vm.ketString(vm.ket))
+      }
+  }
+}
+
+func TestBig(t *testing.T) {
+  for _, nursery := range []int{0, 500} {
+      vm := newVm(1<<12)
+      vm.gcQuiet = true
+      vm.setGenerational(nursery)
+      test := vm.makeTest(t)
+      twos := "[" + strings.Repeat("2 ", 200) + "]"
+      want := new(big.Int).Lsh(big.NewInt(1), 200)
+      test("reduce [*] 1 " + twos, want.String())
+      test("eq reduce [*] 1 " + twos + " " + want.String(), "1")
+      test("- 1 576460752303423488 + 1 576460752303423487", "-576460752303423487 576460752303423488")
+      test("typ * 10000000000 100000000000", "1")
+      test("* 2 #[1 576460752303423487 x]", "#[2 1152921504606846974]")
+      // big ints move in the gc
+      vm.reset()
+      vm.bra = vm.makeBra("map [* 3 reduce [*] 1 tens' drop] ones'" +
+          " def tens' [" + strings.Repeat("10 ", 30) + "] def ones' [" + strings.Repeat("1 ", 100) + "]")
+      vm.evalBra()
+      if vm.gcStats.Collections < 2 {
+          t.Error("no collection, nursery", nursery)
+      }
+      want = new(big.Int).Mul(big.NewInt(3), new(big.Int).Exp(big.NewInt(10), big.NewInt(30), nil))
+      if out := vm.ketString(vm.ket); out != "[" + strings.TrimSpace(strings.Repeat(want.String() + " ", 100)) + "]" {
+          t.Error("big ints after gc", out)
+      }
+  }
+}
+
+func TestDivision(t *testing.T) {
+  vm := init_vm()
+  test := vm.makeTest(t)
+  for _, c := range []struct{name, want string}{
+      {"zero", "0 0 [0 1]"}, {"one", "1 1 [1 1]"}, {"numerator", "7 7 [7 1]"}} {
+      if err := vm.SetDivision(c.name); err != nil {
+          t.Fatal(err)
+      }
+      test("/ 7 0 mod 7 0 / [7 3] [0 3]", c.want)
+  }
+  vm.SetDivision("halt")
+  vm.reset()
+  vm.bra = vm.makeBra("+ 1 / 7 0")
+  vm.evalBra()
+  if vm.err == nil || vm.err.Error() != "division by zero" {
+      t.Error("division by zero does not halt", vm.err)
+  }
+  if vm.SetDivision("nope") == nil {
+      t.Error("unknown division accepted")
+  }
+}
+
+func TestFloat(t *testing.T) {
+  vm := init_vm()
+  test := vm.makeTest(t)
+  test("+ 1 0.5 * 2 [1.5 x] typ 2.0", "1.5 [3.0] 8")
+  test("eq 0.1 + 0.05 0.05 to-int 1e300 to-float 12345678901234567890", "1 576460752303423487 12345678901234567000.0")
+  // protected, nothing gives Inf or NaN
+  for _, prim := range []string{"/ 0.0", "/ 1e300", "log", "sqrt", "exp", "tan", "pow -2.5", "pow 1e300", "* 1e300"} {
+      for _, x := range []string{"0.0", "-0.5", "1e300", "-1e300", "1e-300", "0"} {
+          vm.reset()
+          vm.bra = vm.makeBra(prim + " " + x)
+          vm.evalBra()
+          if !isFloat(vm.car(vm.ket)) {
+              continue
+          }
+          if f := unboxFloat(vm.car(vm.ket)); math.IsNaN(f) || math.IsInf(f, 0) {
+              t.Errorf("%s %s gives %v", prim, x, f)
+          }
+      }
+  }
+  vm.SetIEEE(true)
+  vm.reset()
+  vm.bra = vm.makeBra("/ 1.0 0 log-e 0 sqrt -1.0")
+  vm.evalBra()
+  if out := vm.ketString(vm.ket); out != "+Inf -Inf NaN" {
+      t.Error("ieee floats give", out)
+  }
+  // printed floats read back as the same float
+  vm.SetIEEE(false)
+  var r rng
+  r.seed(1)
+  for i := 0; i < 1000; i++ {
+      x := boxFloat(math.Float64frombits(r.next() >> 2))
+      if y, _ := vm.parse([]byte(floatText(x))); y != x {
+          t.Errorf("%s reads back as %s", floatText(x), floatText(y))
+      }
+  }
+}
+
+func TestRegisterPrim(t *testing.T) {
+  vm := init_vm()
+  test := vm.makeTest(t)
+  sensor := 0
+  _, err := vm.RegisterPrim("sq", 1, func(vm *Vm) error {
+      var n value
+      vm.pop(&vm.ket, &n)
+      vm.ket = vm.cons(boxInt(unbox(n)*unbox(n)), vm.ket)
+      return nil
+  })
+  if err != nil {
+      t.Fatal(err)
+  }
+  vm.RegisterPrim("sense", 0, func(vm *Vm) error {
+      sensor++
+      vm.ket = vm.cons(boxInt(sensor), vm.ket)
+      return nil
+  })
+  vm.RegisterPrim("fail", 0, func(vm *Vm) error {
+      return errors.New("actuator broken")
+  })
+  if _, err := vm.RegisterPrim("dup", 1, nil); err == nil {
+      t.Error("builtin primitive could be registered")
+  }
+
+  test("sq 3", "9")
+  test("sq sq 2 1", "16 1")
+  test("sq", "")                 // too few arguments
+  test("sense sense", "2 1")
+  test("typ sq'", "2")
+  test("car [sq]", "sq")
+  test("10 fail 20", "20")       // error halts evaluation
+  if vm.err == nil || vm.err.Error() != "fail: actuator broken" {
+      t.Error("wrong error", vm.err)
+  }
+  test("__show results__", "")
+}
+
+func TestPrimSet(t *testing.T) {
+  vm := init_vm()
+  run := func(code string) string {
+      vm.bra = vm.makeBra(code)
+      vm.ket = nill
+      vm.evalBra()
+      return fmt.Sprint(vm.ketInts())
+  }
+  prog := vm.makeBra("x def x' 1 2")   // parsed while def is enabled
+  argProg := vm.makeBra("eval [5 def [x]]")   // shaped like the code of a closure
+
+  if err := vm.UsePrimSet("pure"); err != nil {
+      t.Fatal(err)
+  }
+  for _, p := range vm.ActivePrims() {
+      if p == def || p == print || p == trace {
+          t.Error("disabled primitive", vm.primName(p), "is active")
+      }
+  }
+  if got := run("+ 1 2"); got != "[3]" {
+      t.Error("+ 1 2 gives", got)
+  }
+  // def is read as an (unbound) symbol
+  if vm.car(vm.makeBra("def")) != string2symbol("def") {
+      t.Error("disabled primitive def is parsed as a primitive")
+  }
+  // executing a disabled primitive is a no-op ..
+  vm.bra = prog
+  vm.ket = nill
+  vm.evalBra()
+  // def leaves key and values on the ket, x remains unbound
+  if got := vm.ketInts(); len(got) != 4 || got[0] != 0 {
+      t.Error("disabled def gives", got)
+  }
+  // .. or an error in strict mode
+  vm.primSet.Strict = true
+  vm.bra = prog
+  vm.evalBra()
+  if vm.err == nil {
+      t.Error("strict primitive set does not halt")
+  }
+  vm.bra = argProg
+  vm.evalBra()
+  if vm.err == nil {
+      t.Error("strict primitive set runs def of user code")
+  }
+  vm.err = nil
+  // closures bind their arguments without def, the words of the prelude use def
+  for code, want := range map[string]string{"eval \\[x] [+ x 1] 3": "[4]",
+      "+ 1 eval \\[x y] [- x y] 10 3": "[8]", "caddr [1 2 3]": "[1]",
+      "repeat 3 [+ 2] 0": "[6]", "size [1 2 3]": "[3]", "last [4 5 6]": "[4]",
+      "sum [1 2 3]": "[6]", "car map [+ 1] [1 2]": "[3]", "car filter [> 1] [0 5 7]": "[0]"} {
+      vm.reset()
+      vm.loadPrelude(preludeSrc)
+      if got := run(code); got != want || vm.err != nil {
+          t.Error(code, "gives", got, vm.err)
+      }
+  }
+  vm.UsePrimSet("full")
+  if got := run("x def x' 1 2"); got != "[1 2]" {
+      t.Error("full primitive set gives", got)
+  }
+}
+
+// ints on the ket, top first (nill is shown as 0)
+func (vm *Vm) ketInts() (l []int) {
+  for k := vm.ket; isCell(k); k = vm.cdr(k) {
+      l = append(l, unbox(vm.car(k)))
+  }
+  return
+}
+
+// known solutions of the benchmark problems have error 0
+// and a few wrong ones their known error
+func TestProblems(t *testing.T) {
+  xnor := "bool-or bool-and b0 b1 bool-and bool-not b0 bool-not b1"
+  for _, c := range []struct{problem, code string; err float64}{
+      {"quartic", "+ x * x + x * x + x * x x", 0},
+      {"nguyen8", "exp-e / log-e x + 1 1", 0},
+      {"nguyen10", "* sin x + cos y cos y", 0},
+      {"parity3", "bool-not bool-or bool-and " + xnor + " b2 bool-and bool-not " + xnor + " bool-not b2", 0},
+      {"parity3", "b0", 4},
+      {"mux6", "eval if a1 [eval if a0 [d3] [d2]] [eval if a0 [d1] [d0]]", 0},
+      {"ant", "eval if food [move] [move eval if food [move] [left] right left right eval if food [move] [right] left]", 0},
+      {"ant", "left", 89},
+      {"square", "+ 1 * dup", 0},
+  } {
+      vm := newVm(1<<16)
+      e, err := vm.newEvolver(problems[c.problem], defaultEvolve)
+      if err != nil {
+          t.Fatal(err)
+      }
+      if got := e.eval(genome{c.code}); got != c.err {
+          t.Errorf("%s: %s has error %g", c.problem, c.code, got)
+      }
+  }
+}
+
+// each vm has its own ant, so they can run side by side (go test -race)
+func TestAntVms(t *testing.T) {
+  solution := genome{"eval if food [move] [move eval if food [move] [left] right left right eval if food [move] [right] left]"}
+  errs := make(chan float64)
+  for i := 0; i < 4; i++ {
+      go func() {
+          vm := newVm(1<<16)
+          vm.gcQuiet = true
+          e, err := vm.newEvolver(problems["ant"], defaultEvolve)
+          if err != nil {
+              errs <- -1
+              return
+          }
+          sum := 0.0
+          for j := 0; j < 10; j++ {
+              sum += e.eval(solution)
+          }
+          errs <- sum
+      }()
+  }
+  for i := 0; i < 4; i++ {
+      if e := <-errs; e != 0 {
+          t.Error("ant in parallel vms has error", e)
+      }
+  }
+}
+
+// evaluation of random genomes, to catch a slower evalBra
+func BenchmarkProblems(b *testing.B) {
+  for _, name := range []string{"quartic", "nguyen9", "parity5", "mux11", "ant"} {
+      b.Run(name, func(b *testing.B) {
+          vm := newVm(1<<16)
+          vm.gcQuiet = true
+          e, err := vm.newEvolver(problems[name], defaultEvolve)
+          if err != nil {
+              b.Fatal(err)
+          }
+          gs := make([]genome, 100)
+          for i := range gs {
+              gs[i] = e.random()
+          }
+          b.ResetTimer()
+          for i := 0; i < b.N; i++ {
+              e.eval(gs[i%len(gs)])
+          }
+      })
+  }
+}
+
+func TestStackEffect(t *testing.T) {
+  vm := init_vm()
+  vm.loadPrelude(preludeSrc)
+  for _, c := range [][2]string{
+      {"1 2 3",            "( 0 -- 3 )"},
+      {"dup",              "( 1 -- 2 )"},
+      {"drop 1",           "( 0 -- 0 )"},
+      {"+",                "( 2 -- 0..1 )"},
+      {"+ 1 2",            "( 0 -- 0..1 )"},
+      {"swapd",            "( 3 -- 3 )"},      // prelude word
+      {"eval [dup]",       "( 1 -- 2 )"},
+      {"dip [drop] 1 2",   "( 0 -- 1 )"},
+      {"f 2 def f' [* dup]",        "( 0 -- 0..1 )"},
+      {"eval if x [drop] [+]",      "( 2 -- 0..1 )"},   // x is nill
+      {"eval if rot [drop] [drop drop 1]",  "( 2 -- 0 )"},
+      {"eval if rot [drop] [1]",    "( 1 -- ? )"},
+      {"eval \\[x y] [1] 1 2",      "( 0 -- 1 )"},
+      {"eval \\[x y] [x] 1 2",      "( 0 -- ? )"},  // x might be code
+      {"def [a b]",                 "( 2 -- 0 )"},
+      {"eval [ rec gt 0 dup add 1 dup] -5",  "( 0 -- ? )"},
+      {"f def f' [f]",              "( 0 -- ? )"},
+      {"assoc a' 1 {}",             "( 0 -- 0..1 )"},
+      {"ne 1",                      "( 1 -- 1 )"},
+  } {
+      if e := vm.stackEffect(vm.makeBra(c[0])); e.String() != c[1] {
+          t.Errorf("%s: effect %s, want %s", c[0], e, c[1])
+      }
+  }
+  c := vm.newChecker(0)
+  c.run(vm.makeBra("1 drop drop"))
+  if c.underflow != "drop" {
+      t.Error("underflow not detected")
+  }
+  c = vm.newChecker(0)
+  c.run(vm.makeBra("drop car 1"))  // car of 1 pushes nothing, but car [1] ..
+  if c.underflow != "" {
+      t.Error("underflow not certain, but reported")
+  }
+}
+
+func TestSimplify(t *testing.T) {
+  vm := init_vm()
+  run := func(q value) []int {
+      vm.env = vm.mcons(nill, nill)
+      vm.ket = nill
+      vm.bra = q
+      vm.evalBra()
+      return vm.ketInts()
+  }
+  for _, c := range [][2]string{
+      {"drop 1 5",                  "5"},
+      {"drop dup 5",                "5"},
+      {"drop x' 5",                 "5"},
+      {"+ 2 3",                     "5"},
+      {"* + 1 2 3",                 "9"},
+      {"- 3 2 / 1 0 / 7 2",         "1 0 3"},
+      {"eq [1 2] [1 2] eq 1 x'",    "1 0"},
+      {"swap swap 1 2",             "1 2"},
+      {"swap swap",                 "swap swap"},   // ket might be short
+      {"+ swap dup 3",              "+ dup 3"},
+      {"eval if 1 [+ 2 3] [drop 7]",  "eval [5]"},
+      {"x def x' 3 def y' 4",       "x def x' 3"},
+      {"f 2 def f' [* dup drop 1]", "f 2 def f' [* dup]"},
+      {"car f def f' [drop 1 2]",   "car f def f' [drop 1 2]"},  // f might be data
+      {"[drop 1 2]",                "[drop 1 2]"},
+      {"/ 1 0.0 / 3 2.0",           "0.0 1.5"},
+      {"bit-and 1.5 2 bit-or 1 x'", "bit-and 1.5 2 bit-or 1 x'"},   // push nothing
+  } {
+      q := vm.makeBra(c[0])
+      s := vm.simplify(q)
+      if !vm.isEqual(s, vm.makeBra(c[1])) {
+          vm.printBra(s)
+          t.Errorf("%s: not simplified to %s", c[0], c[1])
+      }
+      want, got := run(q), run(s)
+      if fmt.Sprint(want) != fmt.Sprint(got) {
+          t.Errorf("%s: ket %v, simplified %v", c[0], want, got)
+      }
+  }
+  vm.SetDivision("halt")   // a halting division stays, the vm is not halted
+  for _, c := range []string{"/ 1 0", "/ 1 0.0", "mod 1 -0.0"} {
+      vm.err = nil
+      if s := vm.simplify(vm.makeBra(c)); !vm.isEqual(s, vm.makeBra(c)) || vm.err != nil {
+          t.Errorf("%s simplified with division halt, %v", c, vm.err)
+      }
+  }
+  // primitives read before the set was switched are disabled, they stay
+  q, want := vm.makeBra("+ 1 2 swap swap 3 4"), vm.makeBra("+ 1 2 3 4")
+  vm.UsePrimSet("stack")
+  if s := vm.simplify(q); !vm.isEqual(s, want) {
+      vm.printBra(s)
+      t.Error("disabled primitive simplified")
+  }
+  vm.UsePrimSet("full")
+  // a folded big int which does not fit into the arena
+  small := newVm(1024)
+  q = small.makeBra("* 100000000000000000000 100000000000000000000")
+  small.next = len(small.arena) - 2
+  if s := small.simplify(q); s != q {
+      t.Error("simplified without room in the arena")
+  }
+}
+
+func TestFormat(t *testing.T) {
+  vm := init_vm()
+  src, err := ioutil.ReadFile("prelude.clj")
+  if err != nil {
+      t.Fatal(err)
+  }
+  prelude := vm.makeBra(string(src))
+  for _, w := range []int{80, 40, 10} {
+      out := FormatSource(src, w)
+      if !vm.isEqual(vm.makeBra(string(out)), prelude) {
+          t.Errorf("width %d: formatted prelude differs", w)
+      }
+      if bytes.Count(out, []byte(";")) != bytes.Count(src, []byte(";")) {
+          t.Errorf("width %d: comments lost", w)
+      }
+      if !bytes.Equal(FormatSource(out, w), out) {
+          t.Errorf("width %d: formatting not stable", w)
+      }
+  }
+
+  q := vm.makeBra("def f' \\[x] [+ x 1 [a [b [c d]]]] x` y [1 2]' eval [dup] rot")
+  want := "[\n  def f' \\[x] [\n    + x 1\n    [a [b [c d]]]\n  ] x` y [1 2]' eval\n  [dup] rot\n]"
+  if out := vm.PrettyPrint(q, 20); out != want {
+      t.Errorf("pretty-printed as\n%s", out)
+  }
+  for _, w := range []int{80, 20, 5} {
+      if !vm.isEqual(vm.car(vm.makeBra(vm.PrettyPrint(q, w))), q) {
+          t.Errorf("width %d: pretty-printed value differs", w)
+      }
+  }
+  // the parser and the formatter read the same tokens, comments only for the formatter
+  var texts []string
+  for _, tk := range scan([]byte("f x'y ; [c\n#[1]\\[z]"), true) {
+      texts = append(texts, fmt.Sprintf("%s/%d/%v", tk.text, tk.line, tk.glued))
+  }
+  if got := strings.Join(texts, " "); got != "f/1/false x/1/false '/1/true y/1/true ; [c/1/false #/2/false [/2/true 1/2/true ]/2/true \\/2/true [/2/true z/2/true ]/2/true" {
+      t.Error("scanned as", got)
+  }
+  if got := fmt.Sprintf("%s", tokenize([]byte("f x'y ; [c\n#[1]"))); got != "[f x esc y # [ 1 ]]" {
+      t.Error("tokenized as", got)
+  }
+}
+
+func TestScripts(t *testing.T) {
+  files, _ := filepath.Glob("tests/*.clj")
+  if len(files) == 0 {
+      t.Fatal("no test files found")
+  }
+  vm := init_vm()
+  for _, f := range files {
+      cases, err := readScript(f)
+      if err != nil {
+          t.Error(err)
+          continue
+      }
+      t.Run(filepath.Base(f), func(t *testing.T) {
+          for _, c := range cases {
+              t.Run(fmt.Sprint("line", c.line), func(t *testing.T) {
+                  vm = vm.recycle()
+                  vm.gcQuiet = true
+                  vm.loadPrelude(preludeSrc)
+                  if report := vm.runCase(c); report != "" {
+                      t.Error(report)
+                  }
+              })
+          }
+      })
+  }
+}
+
+func TestScriptsFreshVm(t *testing.T) {
+  // the same case twice gives the same numbers on a vm seeded alike
+  f := filepath.Join(t.TempDir(), "rnd.clj")
+  vm := newVm(4096)
+  vm.rng.seed(7)
+  vm.bra = vm.makeBra("rnd 1000")
+  vm.evalBra()
+  want := vm.ketString(vm.ket)
+  os.WriteFile(f, []byte("expect [" + want + "] rnd 1000\nexpect [" + want + "] rnd 1000\n"), 0644)
+  fresh := func() (*Vm, error) {
+      v := newVm(4096)
+      v.rng.seed(7)
+      return &v, nil
+  }
+  if failed, err := runScripts([]string{f}, fresh, ioutil.Discard); err != nil || failed != 0 {
+      t.Error("cases not run on fresh vms:", failed, err)
+  }
+}
+
+func TestVmErrors(t *testing.T) {
+  vm := newVm(1000)
+  vm.gcQuiet = true
+  vm.bra = vm.makeBra("eval [rec 1 0]")   // ket grows without end
+  vm.evalBra()
+  if vm.err == nil {
+      t.Error("exhausted arena not reported")
+  }
+
+  vm.reset()
+  vm.stack = make([]value, 100)
+  vm.bra = vm.makeBra("f def f' [f 1]")   // scopes nest without end
+  vm.evalBra()
+  if vm.err == nil || vm.stackIndex != -1 {
+      t.Error("stack overflow not reported", vm.err)
+  }
+
+  vm.reset()
+  vm.maxSteps = 50
+  vm.bra = vm.makeBra("eval [rec 1 drop]")
+  vm.evalBra()
+  if vm.err == nil || vm.stats.nSteps != 50 {
+      t.Error("step budget not kept", vm.stats.nSteps)
+  }
+  vm.bra = vm.makeBra("+ 1 2")   // the next evaluation starts afresh
+  vm.evalBra()
+  if vm.err != nil || vm.ketString(vm.ket) != "3" {
+      t.Error("evaluation after a halt", vm.err, vm.ketString(vm.ket))
+  }
+
+  vm.reset()
+  vm.maxSteps = 0
+  vm.bra = vm.makeBra("rnd []")
+  vm.evalBra()
+  if vm.err != nil || vm.ketString(vm.ket) != "[]" {
+      t.Error("rnd of empty list", vm.ketString(vm.ket))
+  }
+
+  vm = newVm(1<<18)
+  vm.gcQuiet = true
+  vm.bra = vm.makeBra("f def f' [map f' [1]]")   // map calls nest without end
+  vm.evalBra()
+  if vm.err == nil || vm.calls != 0 || vm.stackIndex != -1 {
+      t.Error("nested calls not stopped", vm.err)
+  }
+
+  vm.reset()
+  vm.maxSteps = 100
+  vm.bra = vm.makeBra("each [eval [rec 1]] [1 2 3]")   // halt inside the callback
+  vm.evalBra()
+  if vm.err == nil || vm.stats.nSteps > 101 || vm.stackIndex != -1 {
+      t.Error("halt inside each", vm.err, vm.stats.nSteps)
+  }
+
+  // a halt after a gc keeps the bindings, by the step budget or a vm panic
+  for _, c := range []struct{cells, steps int; code string}{
+      {1024, 20000, "eval [rec 1 drop [1 2 3 4 5 6 7 8 9 10]]"},
+      {1<<16, 0, "f def f' [map f' [1 2 3 4 5 6 7 8 9 10]]"},
+  } {
+      vm = newVm(c.cells)
+      vm.gcQuiet = true
+      vm.maxSteps = c.steps
+      vm.bra = vm.makeBra("def x' 42 def y' [1 2 3]")
+      vm.evalBra()
+      vm.bra = vm.makeBra(c.code)
+      vm.evalBra()
+      if vm.err == nil || vm.gcStats.Collections == 0 {
+          t.Error("no halt after a gc", c.code, vm.err)
+      }
+      vm.ket = nill
+      vm.bra = vm.makeBra("x")
+      vm.evalBra()
+      if vm.ketString(vm.ket) != "42" {
+          t.Error("binding lost after a halt", c.code, vm.ketString(vm.ket))
+      }
+  }
+}
+
+// every string is a program, which must neither panic nor run forever
+func FuzzEval(f *testing.F) {
+  for _, s := range []string{"1 2 3", "eval [rec 1 0]", "rnd \\[x] []",
+          "fac 4 def fac' [eval if rot [1 drop] [* fac - swap 1 dup] eq 1 dup]",
+          "map [* dup] [1 2 3]", "f def f' [f 1]", "eval \\[x y] [+ x y] 1 2",
+          "filter [gt 2] reduce [cons] [] each [dup] [1 2 3]",
+          "keys dissoc 1 reduce [assoc dup] {a 1} [1 2 3]",
+          "nth 2 set-nth 1 9 slice 1 9 + #[1 2 3] #[4 5 6]",
+          "eq 0 / x - 1 x def x' * dup * dup * dup 576460752303423487",
+          "shift 1 pow 2 pow 3 sqrt neg mod 7 abs -1 bool-and bool-not bool-or 0 1 [1]",
+          "to-int exp-e 1e300 log-e 0 sin [1.5 x] / -2.5 0 pow -8.0 0.5 rnd 1.0"} {
+      f.Add(s)
+  }
+  vm := newVm(1<<12)   // small enough to run out of cells
+  vm.gcQuiet = true
+  f.Fuzz(func(t *testing.T, code string) {
+      vm.reset()
+      vm.maxSteps = 20000
+      vm.loadPrelude(preludeSrc)
+      vm.bra = vm.makeBra(code)
+      vm.evalBra()
+      if vm.stackIndex != -1 || vm.calls != 0 {
+          t.Error("scopes left after evaluation", vm.stackIndex, vm.calls)
+      }
+  })
+}
+
+// formatted and pretty-printed code parses back into the same program
+func FuzzParse(f *testing.F) {
+  for _, s := range []string{"1 2 3", "def f' \\[x] [+ x 1] ; comment\n f`",
+          "[1 2]' [[a]b]c ] [", "x'y `z \\ 99999999999999999999999",
+          "{a 1 [b] {c}}' {} {x", "#[1 #[2]]' # [3] a#[4]", "1.5 -2e-3 .5 3. 1e400 -0.0"} {
+      f.Add(s)
+  }
+  vm := newVm(1<<20)
+  f.Fuzz(func(t *testing.T, src string) {
+      vm.reset()
+      q := vm.makeBra(src)
+      if out := FormatSource([]byte(src), 20); !vm.isEqual(vm.makeBra(string(out)), q) {
+          t.Errorf("formatted as %q", out)
+      }
+      if out := vm.PrettyPrint(q, 20); !vm.isEqual(vm.car(vm.makeBra(out)), q) {
+          t.Errorf("pretty-printed as %q", out)
+      }
+  })
+}
+
+func TestLoadFile(t *testing.T) {
+  vm := init_vm()
+  dir := t.TempDir()
+  if err := ioutil.WriteFile(dir + "/lib.clj", []byte("sq 3 def sq' [* dup]"), 0644); err != nil {
+      t.Fatal(err)
+  }
+  if _, err := vm.loadFile("lib.clj"); err == nil {
+      t.Error("missing file not reported")
+  }
+  t.Setenv("BRACKET_PATH", "/nonexistent" + string(filepath.ListSeparator) + dir)
+  q, err := vm.loadFile("lib.clj")
+  if err != nil {
+      t.Fatal(err)
+  }
+  vm.bra = q
+  vm.evalBra()
+  if vm.ketString(vm.ket) != "9" {
+      t.Error("loaded file gives", vm.ketString(vm.ket))
+  }
+  if src, _ := preludeSource(""); src != preludeSrc || src == "" {
+      t.Error("prelude not built in")
+  }
+}
+
+// the same seed gives the same run, also with rnd in the genomes
+func TestEvolve(t *testing.T) {
+  opt := defaultEvolve
+  opt.PopSize, opt.Gens = 50, 5
+  sq := problems["square"]
+  full := &Problem{Name: "square-full", PrimSet: "full", Consts: sq.Consts, Cases: sq.Cases}
+  for _, p := range []*Problem{sq, full} {
+      var runs []string
+      for i := 0; i < 2; i++ {
+          vm := newVm(1<<16)
+          vm.gcQuiet = true
+          g, e, err := vm.evolve(p, opt)
+          if err != nil || len(g) == 0 {
+              t.Fatal("evolve gives", g, err)
+          }
+          runs = append(runs, fmt.Sprint(g, e, vm.rng))
+      }
+      if runs[0] != runs[1] {
+          t.Error(p.Name, "runs with the same seed differ:", runs)
+      }
+  }
+  // the simplified program is kept only if it does the same
+  vm := newVm(1<<16)
+  vm.gcQuiet = true
+  vm.evolve(sq, opt)
+  if s := vm.simplifyGenome(sq, genome{"+", "x", "+", "1", "2"}); s != "+ x 3" {
+      t.Error("simplified genome", s)
+  }
+  size := &Problem{Name: "size", Fitness: func(vm *Vm, prog value) float64 {
+      return float64(vm.length(prog))
+  }}
+  if s := vm.simplifyGenome(size, genome{"+", "1", "2"}); s != "+ 1 2" {
+      t.Error("genome with another error simplified to", s)
+  }
+}
+
+func TestCli(t *testing.T) {
+  run := func(stdin string, args ...string) (string, int) {
+      var out bytes.Buffer
+      if args[0] != "evolve" {   // keep the arenas small
+          args = append(args, "-arena", "65536")
+      }
+      code := cli(args, strings.NewReader(stdin), &out)
+      return out.String(), code
+  }
+  tests := []struct {
+      args []string
+      out  string
+      code int
+  }{
+      {[]string{"run", "-e", "+ 1 2 [3 x]", "--no-prelude"}, "3 [3 x]\n", 0},
+      {[]string{"run", "-o", "json", "-e", "1 [2 x] 3"}, "[1,[2,\"'x\"],3]\n", 0},
+      {[]string{"run", "-e", "1 2", "-o", "ket"}, "[1 2>\n", 0},
+      {[]string{"run", "-max-steps", "100", "-e", "eval [rec 1]"}, "", 1},
+      {[]string{"run", "-division", "one", "-e", "/ 5 0"}, "1\n", 0},
+      {[]string{"run", "-division", "halt", "-e", "/ 5 0"}, "", 1},
+      {[]string{"run", "-e", "/ 1.0 0 log-e 0"}, "0.0 0.0\n", 0},
+      {[]string{"run", "-ieee", "-e", "/ 1.0 0 log-e 0"}, "+Inf -Inf\n", 0},
+      {[]string{"run"}, "", 2},
+      {[]string{"evolve", "-problem", "nope"}, "", 1},
+  }
+  for _, tt := range tests {
+      out, code := run("", tt.args...)
+      if code != tt.code || tt.out != "" && out != tt.out {
+          t.Errorf("%v gives %q, exit %d", tt.args, out, code)
+      }
+  }
+  if out, _ := run("[[1,2,3],\"x\",-4]", "run", "-e", "sum", "-ket", "-", "-i", "json", "-o", "json"); out != "[6,\"'x\",-4]\n" {
+      t.Errorf("json ket from stdin gives %q", out)
+  }
+  if out, _ := run("", "run", "-e", "- swap", "-ket", "3 10 [x]"); out != "7 [x]\n" {
+      t.Errorf("ket from -ket gives %q", out)
+  }
+  if out, _ := run("def sq' [\n* dup]\nsq 4\n", "repl", "-o", "plain"); !strings.Contains(out, "16") {
+      t.Errorf("repl gives %q", out)
+  }
+  if out, _ := run("", "check", "-e", "+ 1 2"); !strings.HasPrefix(out, "program") {
+      t.Errorf("check gives %q", out)
+  }
+  if out, _ := run("", "evolve", "-pop", "20", "-gens", "1"); !strings.Contains(out, "gen 1") {
+      t.Errorf("evolve gives %q", out)
+  }
+  dir := t.TempDir()   // fmt -write writes the file found on BRACKET_PATH
+  os.WriteFile(filepath.Join(dir, "f.clj"), []byte("1   2"), 0644)
+  os.WriteFile(filepath.Join(dir, "t.clj"), []byte("expect [3] + 1 2"), 0644)
+  t.Setenv("BRACKET_PATH", dir)
+  if cli([]string{"fmt", "-write", "f.clj"}, nil, ioutil.Discard) != 0 {
+      t.Error("fmt -write fails")
+  }
+  if b, _ := ioutil.ReadFile(filepath.Join(dir, "f.clj")); string(b) != "1 2\n" {
+      t.Errorf("fmt -write gives %q", b)
+  }
+  if out, _ := run("", "test", filepath.Join(dir, "t.clj")); out != "1 tests, 0 failed\n" {
+      t.Errorf("test gives %q", out)
+  }
+  os.WriteFile(filepath.Join(dir, "empty.clj"), []byte("; nothing\n"), 0644)
+  if out, _ := run("", "run", "-e", "6", filepath.Join(dir, "empty.clj")); out != "6\n" {
+      t.Errorf("empty program gives %q", out)
+  }
+  for _, p := range []string{"square", "quartic", "ant"} {
+      out, code := run("", "evolve", "-problem", p, "-pop", "20", "-gens", "2", "-q")
+      if code != 0 || !strings.Contains(out, "simplified:") {
+          t.Errorf("evolve %s gives %q, exit %d", p, out, code)
+      }
+  }
+}
+
+func TestInputKet(t *testing.T) {
+  vm := init_vm()
+  k, _ := vm.ParseKet("5 [1 2] x")
+  if vm.ketString(k) != "5 [1 2] x" {
+      t.Error("ParseKet gives", vm.ketString(k))
+  }
+  j, err := vm.ParseKetJSON([]byte(`[5, [1, 2], "x"]`))
+  if err != nil || !vm.isEqual(j, k) {
+      t.Error("ParseKetJSON gives", vm.ketString(j), err)
+  }
+  for _, bad := range []string{`{"a": 1}`, `[true]`, `["a b"]`, `[1`} {
+      if _, err := vm.ParseKetJSON([]byte(bad)); err == nil {
+          t.Errorf("%s accepted", bad)
+      }
+  }
+  vm.ket, _ = vm.ParseKet("7")
+  vm.PushKet(k)
+  if vm.ketString(vm.ket) != "5 [1 2] x 7" {
+      t.Error("PushKet gives", vm.ketString(vm.ket))
+  }
+  // too large for the arena
+  small := newVm(1024)
+  if _, err := small.ParseKet(strings.Repeat("1 ", 2000)); err == nil || err.Error() != "arena exhausted" {
+      t.Error("large ket gives", err)
+  }
+  small = newVm(1024)
+  k, err = small.ParseKet(strings.Repeat("1 ", 300))
+  if err != nil {
+      t.Fatal(err)
+  }
+  if err := small.PushKet(k); err == nil || err.Error() != "arena exhausted" {
+      t.Error("PushKet of a large ket gives", err)
+  }
+}
+
+func TestJSON(t *testing.T) {
+  vm := init_vm()
+  vm.loadPrelude(preludeSrc)
+  vm.bra = vm.makeBra("cons 1 2 1 make 5 def make' [\\[y][+ y x] def x'] " +
+      "[1 [2 x'] -3 [] dup] x' " + strconv.Itoa(maxInt) + " {a [1 2] [b] {}} #[1 [a] #[]] -100000000000000000000 [1.0 -2.5e-9]")
+  vm.evalBra()
+  vm.ket = vm.cons(string2symbol("1"), vm.ket)   // symbol named like an int
+  for k := vm.ket; isCell(k); k = vm.cdr(k) {
+      v := vm.car(k)
+      b, err := vm.EncodeJSON(v)
+      if err != nil {
+          t.Fatal(err)
+      }
+      w, err := vm.DecodeJSON(b)
+      if err != nil || !vm.isEqual(v, w) {
+          t.Errorf("%s read back as %s, %v", b, vm.PrettyPrint(w, 80), err)
+      }
+      if c, _ := vm.EncodeJSON(w); !bytes.Equal(b, c) {   // bindings of closures
+          t.Errorf("%s written again as %s", b, c)
+      }
+  }
+  b, _ := vm.KetJSON(vm.ket)
+  if s := string(b); !strings.HasPrefix(s, `["'1",{"list":[1],"tail":2},1,{"code":`) {
+      t.Error("ket as", s)
+  }
+  vm.bra = vm.makeBra("eval")   // the closure still works after the round trip
+  vm.ket, _ = vm.ParseKetJSON([]byte(`[{"code": ["+", 1, "'x"], "env": [{"x": 5}]}]`))
+  vm.evalBra()
+  if vm.ketString(vm.ket) != "6" {
+      t.Error("closure from JSON gives", vm.ketString(vm.ket))
+  }
+  for _, bad := range []string{`{"a": 1}`, `{"code": 1, "env": []}`, `null`} {
+      if _, err := vm.DecodeJSON([]byte(bad)); err == nil {
+          t.Errorf("%s accepted", bad)
+      }
+  }
+  // too large for the arena
+  small := newVm(1024)
+  big := []byte("[" + strings.Repeat("1, ", 2000) + "1]")
+  if _, err := small.ParseKetJSON(big); err == nil || err.Error() != "arena exhausted" {
+      t.Error("large ket gives", err)
+  }
+  if _, err := small.DecodeJSON(big); err == nil || err.Error() != "arena exhausted" {
+      t.Error("large list gives", err)
+  }
+}
+
+func TestState(t *testing.T) {
+  vm := init_vm()
+  vm.loadPrelude(preludeSrc)
+  for _, s := range []string{"<dup 1 2|3 4>", "<|>", "<x' [1 [2 y']] \\[a] [+ a 1]|[3 4] ?1 >>",
+      "<cons 1 2|[x . 7 8] ?>", "<< 1 2|>"} {
+      bra, ket, err := vm.ReadState(s)
+      if got := vm.StateString(bra, ket); err != nil || got != s {
+          t.Errorf("%s read back as %s, %v", s, got, err)
+      }
+  }
+  for _, tt := range [][2]string{   // state pairs
+      {"<dup 1 2|", "<|1 1 2>"},
+      {"<swap 1 2|3>", "<|2 1 3>"},
+      {"|1 2>", "<|1 2>"},
+      {"<1 2 3 ; a comment\n|>", "<|1 2 3>"},
+      {"<+|1 2>", "<|3>"},
+      {"<map [* dup]|[1 2 3]>", "<|[1 4 9]>"},
+      {"<sum [1 2]]", "<|3>"},
+      {"[5 6>", "<|5 6>"},
+  } {
+      if got, err := vm.EvalState(tt[0]); err != nil || got != tt[1] {
+          t.Errorf("%s gives %s, %v", tt[0], got, err)
+      }
+  }
+  for _, bad := range []string{"dup 1 2", "<dup 1|2", "|", "1 2>"} {
+      if _, _, err := vm.ReadState(bad); err == nil {
+          t.Errorf("%s accepted", bad)
+      }
+  }
+}
@@ -0,0 +1,375 @@
+// static stack effects of bracket code
+// the checker walks a quotation in the order of evaluation and infers
+// how many elements it takes from the ket and how many it leaves.
+// This allows to sort out obviously broken genomes before evaluation.
+package main
+
+import (
+    "fmt"
+    "io"
+    "sort"
+)
+
+// stack effect of a piece of code
+// outputs can be uncertain (e.g. car of an atom pushes nothing),
+// so the change of the ket depth is given as a range dLo..dHi
+type effect struct {
+    in    int   // ket depth needed so that no primitive runs short
+    inMin int   // below this ket depth a primitive certainly runs short
+    dLo   int   // change of the ket depth, lowest ..
+    dHi   int   // .. and highest
+    known bool  // false if the effect could not be inferred for all code
+}
+
+func (e effect) String() string {
+    out := fmt.Sprint(e.in + e.dLo)
+    if e.dHi != e.dLo {
+        out += fmt.Sprint("..", e.in + e.dHi)
+    }
+    if !e.known {
+        out = "?"
+    }
+    return fmt.Sprintf("( %d -- %s )", e.in, out)
+}
+
+// effect of the primitives: arguments taken, min and max results
+var primEffect = map[value][3]int {
+    dup: {1,2,2}, drop: {1,0,0}, swap: {2,2,2}, rot: {3,3,3},
+    cons: {2,1,1}, car: {1,0,1}, cdr: {1,1,1},
+    add: {2,0,1}, sub: {2,0,1}, mul: {2,0,1}, div: {2,0,1},
+    gt: {2,0,1}, lt: {2,0,1}, rnd: {1,1,1}, eq: {2,1,1}, iff: {3,1,1},
+    val: {1,1,1}, trace: {1,0,0}, typ: {1,1,1}, print: {1,0,0},
+    gcstat: {0,1,1}, lambda: {2,0,1},
+    reverse: {1,0,1}, concat: {2,0,1}, size: {1,0,1}, nth: {2,0,1},
+    take: {2,0,1}, dropn: {2,0,1}, last: {1,0,1}, mapp: {2,0,1}, filter: {2,0,1},
+    assoc: {3,0,1}, get: {2,0,1}, dissoc: {2,0,1}, keys: {1,0,1}, has: {2,0,1},
+    setnth: {3,0,1}, slice: {3,0,1},
+    mod: {2,0,1}, neg: {1,0,1}, abs: {1,0,1}, minimum: {2,0,1}, maximum: {2,0,1},
+    pow: {2,0,1}, sqrt: {1,0,1}, ge: {2,0,1}, le: {2,0,1}, ne: {2,1,1},
+    bitand: {2,0,1}, bitor: {2,0,1}, bitxor: {2,0,1}, shift: {2,0,1},
+    not: {1,0,1}, and: {2,0,1}, or: {2,0,1},
+    sin: {1,0,1}, cos: {1,0,1}, tan: {1,0,1}, atan: {1,0,1}, tanh: {1,0,1},
+    exp: {1,0,1}, log: {1,0,1}, toFloat: {1,0,1}, toInt: {1,0,1},
+}
+
+// abstract value on the ket, as far as it is known statically
+type absVal struct {
+    v     value
+    known bool
+    clos  bool      // closure made by lambda: quotation v with keys
+    keys  value
+    alts  []absVal  // the two candidates left by an unknown if
+}
+
+type checker struct {
+    vm     *Vm
+    eff    effect
+    top    []absVal  // known elements on top of the ket, top last
+    scopes []map[value]absVal  // bindings made by def, innermost last
+    active map[value]bool      // words under analysis, to stop recursion
+    depth0 int       // ket depth at start, -1 if unknown
+    underflow string // first element which certainly runs short
+}
+
+func (vm *Vm) newChecker(depth0 int) *checker {
+    return &checker{vm: vm, eff: effect{known: true},
+        scopes: []map[value]absVal{{}}, active: map[value]bool{},
+        depth0: depth0}
+}
+
+// stack effect of quotation q
+func (vm *Vm) stackEffect(q value) effect {
+    c := vm.newChecker(-1)
+    c.run(q)
+    return c.eff
+}
+
+// analyze code in a new scope, sharing bindings seen so far
+func (c *checker) sub() *checker {
+    s := &checker{vm: c.vm, eff: effect{known: true}, active: c.active,
+        depth0: -1}
+    s.scopes = append(append([]map[value]absVal(nil), c.scopes...), map[value]absVal{})
+    return s
+}
+
+func (c *checker) run(q value) {
+    var e value
+    for c.eff.known && c.vm.pop(&q, &e) {
+        switch {
+        case isNil(e):
+            c.push(absVal{v: nill, known: true})
+        case isPrim(e):
+            c.prim(e, &q)
+        case isSymb(e):
+            c.word(e, &q)
+        default:   // numbers and quotations
+            c.push(absVal{v: e, known: true})
+        }
+    }
+}
+
+// account for code with effect e
+func (c *checker) apply(name string, e effect) {
+    if need := e.in - c.eff.dLo; need > c.eff.in {
+        c.eff.in = need
+    }
+    if need := e.inMin - c.eff.dHi; need > c.eff.inMin {
+        c.eff.inMin = need
+    }
+    if c.depth0 >= 0 && c.underflow == "" && c.depth0 + c.eff.dHi < e.inMin {
+        c.underflow = name
+    }
+    c.eff.dLo += e.dLo
+    c.eff.dHi += e.dHi
+    if !e.known {
+        c.eff.known = false
+    }
+}
+
+// take n arguments for primitive name, the known ones are returned
+// top first, unknown ones are filled in
+func (c *checker) take(name string, n int) []absVal {
+    c.apply(name, effect{n, n, -n, -n, true})
+    args := make([]absVal, n)
+    for i := range args {
+        if l := len(c.top); l > 0 {
+            args[i] = c.top[l-1]
+            c.top = c.top[:l-1]
+        }
+    }
+    return args
+}
+
+func (c *checker) push(vals ...absVal) {
+    c.apply("", effect{0, 0, len(vals), len(vals), true})
+    c.top = append(c.top, vals...)
+}
+
+// push between lo and hi unknown results
+func (c *checker) results(lo, hi int) {
+    c.apply("", effect{0, 0, lo, hi, true})
+    c.top = c.top[:0]   // ket contents no longer known
+    if lo == hi {
+        for i:=0; i<lo; i++ {
+            c.top = append(c.top, absVal{})
+        }
+    }
+}
+
+func (c *checker) lookup(key value) absVal {
+    for i := len(c.scopes)-1; i >= 0; i-- {
+        if v, ok := c.scopes[i][key]; ok {
+            return v
+        }
+    }
+    val := c.vm.boundvalue(key)
+    if isClosure(val) {   // closures of the environment hold their keys already
+        val = c.vm.car(val)
+    }
+    return absVal{v: val, known: true}
+}
+
+func (c *checker) word(sym value, q *value) {
+    v := c.lookup(sym)
+    if v.known && !v.clos && isAtom(v.v) {
+        c.push(v)
+        return
+    }
+    if c.active[sym] {   // recursion
+        c.eff.known = false
+        return
+    }
+    c.active[sym] = true
+    c.eval(symbol2string(sym), v, q)
+    delete(c.active, sym)
+}
+
+// effect of evaluating v
+func (c *checker) eval(name string, v absVal, q *value) {
+    switch {
+    case len(v.alts) > 0:   // the effect of both candidates must agree
+        var e effect
+        for i, a := range v.alts {
+            s := c.sub()
+            s.eval(name, a, q)
+            if i > 0 && (s.eff != e) {
+                c.eff.known = false
+                return
+            }
+            e = s.eff
+        }
+        c.apply(name, e)
+        c.top = c.top[:0]
+    case !v.known:
+        c.eff.known = false
+    case v.clos:
+        s := c.sub()
+        s.defKeys(v.keys)
+        s.run(v.v)
+        c.apply(name, s.eff)
+        c.top = c.top[:0]
+    case isCell(v.v):
+        s := c.sub()
+        s.run(v.v)
+        c.apply(name, s.eff)
+        c.top = c.top[:0]
+    case isNil(v.v):
+    case isPrim(v.v):
+        c.prim(v.v, q)
+    case isSymb(v.v):
+        c.word(v.v, q)
+    default:   // a number
+        c.push(v)
+    }
+}
+
+// bind the keys of a closure to its arguments
+func (c *checker) defKeys(keys value) {
+    if isNil(keys) {
+        return
+    }
+    if isAtom(keys) {
+        c.take("def", 1)
+        c.scopes[len(c.scopes)-1][keys] = absVal{}
+        return
+    }
+    c.take("def", c.vm.lengthNonQuoted(keys))
+    for k := keys; isCell(k); k = c.vm.cdr(k) {
+        if key := c.vm.car(k); isAtom(key) {
+            c.scopes[len(c.scopes)-1][key] = absVal{}
+        }
+    }
+}
+
+func (c *checker) prim(p value, q *value) {
+    var e value
+    lib := p & libPrim != 0
+    p = plainPrim(p)
+    name := c.vm.primName(p)
+    if !lib && c.vm.primSet != nil && !c.vm.primSet.has(p) {
+        return   // disabled primitives are no-ops
+    }
+    switch p {
+    case esc:
+        if c.vm.pop(q, &e) {
+            c.push(absVal{v: e, known: true})
+        }
+    case vesc:
+        if c.vm.pop(q, &e) {
+            if isCell(e) {
+                c.push(absVal{v: e, known: true})
+            } else {
+                c.push(c.lookup(e))
+            }
+        }
+    case dup:
+        a := c.take(name, 1)
+        c.push(a[0], a[0])
+    case swap:
+        a := c.take(name, 2)
+        c.push(a[0], a[1])
+    case rot:
+        a := c.take(name, 3)
+        c.push(a[1], a[0], a[2])
+    case drop:
+        c.take(name, 1)
+    case iff:
+        a := c.take(name, 3)
+        switch {
+        case a[0].known && istrue(a[0].v):
+            c.push(a[1])
+        case a[0].known:
+            c.push(a[2])
+        case a[1].known && a[2].known:
+            c.push(absVal{alts: []absVal{a[1], a[2]}})
+        default:
+            c.push(absVal{})
+        }
+    case val:
+        a := c.take(name, 1)
+        if a[0].known && isAtom(a[0].v) {
+            c.push(c.lookup(a[0].v))
+        } else {
+            c.push(a[0])
+        }
+    case lambda:
+        a := c.take(name, 2)
+        quote := a[1]
+        if quote.known && isSymb(quote.v) {
+            quote = c.lookup(quote.v)
+        }
+        if quote.known && isCons(quote.v) {
+            c.push(absVal{v: quote.v, known: true, clos: true, keys: a[0].v})
+        } else {
+            c.results(0, 1)
+        }
+    case eval:
+        a := c.take(name, 1)
+        c.eval(name, a[0], q)
+    case dip:
+        a := c.take(name, 2)
+        c.eval(name, a[0], q)
+        c.push(a[1])
+    case def, argdef:
+        a := c.take(name, 1)
+        switch {
+        case !a[0].known:
+            c.eff.known = false
+        case isAtom(a[0].v):
+            v := c.take(name, 1)
+            c.scopes[len(c.scopes)-1][a[0].v] = v[0]
+        default:
+            c.defKeys(a[0].v)
+        }
+    case rec:   // loops are not analyzed
+        c.take(name, 1)
+        c.eff.known = false
+    case each:   // effect depends on the length of the list
+        c.take(name, 2)
+        c.eff.known = false
+    case reduce:
+        c.take(name, 3)
+        c.eff.known = false
+    default:
+        pe, ok := primEffect[p]
+        if !ok {   // registered primitives: results are unknown
+            if up, ok := c.vm.userPrims[p]; ok {
+                c.take(name, up.arity)
+            }
+            c.eff.known = false
+            return
+        }
+        c.take(name, pe[0])
+        c.results(pe[1], pe[2])
+    }
+}
+
+// check a program that starts with depth0 elements on the ket
+// prints the effect of the program and of the words it defines to out,
+// returns false if a primitive certainly runs short of arguments
+func (vm *Vm) check(prog value, depth0 int, out io.Writer) bool {
+    c := vm.newChecker(depth0)
+    c.run(prog)
+    fmt.Fprintln(out, "program", c.eff)
+    var names []string
+    words := map[string]absVal{}
+    for k, v := range c.scopes[0] {
+        if v.known && (v.clos || isCons(v.v)) {
+            names = append(names, symbol2string(k))
+            words[symbol2string(k)] = v
+        }
+    }
+    sort.Strings(names)
+    for _, n := range names {
+        s := c.sub()
+        s.active[string2symbol(n)] = true
+        s.eval(n, words[n], &prog)
+        delete(s.active, string2symbol(n))
+        fmt.Fprintln(out, n, s.eff)
+    }
+    if c.underflow != "" {
+        fmt.Fprintln(out, "underflow:", c.underflow, "runs short of arguments")
+        return false
+    }
+    return true
+}
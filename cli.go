@@ -0,0 +1,428 @@
+// command line interface of bracket
+package main
+
+import (
+    "bufio"
+    "flag"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "os"
+    "strings"
+)
+
+const usage = `usage: bracket <command> [flags] [arguments]
+
+commands:
+  run [file.clj]    evaluate a program, also "bracket file.clj"
+                    arguments after the file are put on the ket
+  repl              read-eval-print loop
+  test [files]      run test cases written in bracket (default: tests/)
+  fmt files         format source code
+  check file.clj    infer stack effects
+  evolve            evolve a program for a problem
+
+"bracket <command> -h" lists the flags of a command
+`
+
+func main() {
+    os.Exit(cli(os.Args[1:], os.Stdin, os.Stdout))
+}
+
+// run the command line args, returns the exit code:
+// 0 success, 1 error (also a halted program or failed tests), 2 bad usage
+func cli(args []string, stdin io.Reader, stdout io.Writer) int {
+    if len(args) == 0 {
+        fmt.Fprint(os.Stderr, usage)
+        return 2
+    }
+    cmd := args[0]
+    switch cmd {
+    case "run":
+        return cmdRun(args[1:], stdin, stdout)
+    case "repl":
+        return cmdRepl(args[1:], stdin, stdout)
+    case "test":
+        return cmdTest(args[1:], stdout)
+    case "fmt":
+        return cmdFmt(args[1:], stdout)
+    case "check":
+        return cmdCheck(args[1:], stdout)
+    case "evolve":
+        return cmdEvolve(args[1:], stdout)
+    case "help", "-h", "-help", "--help":
+        fmt.Fprint(stdout, usage)
+        return 0
+    }
+    return cmdRun(args, stdin, stdout)   // bracket file.clj
+}
+
+// parse flags which may be mixed with the other arguments
+func parseFlags(fs *flag.FlagSet, args []string) ([]string, error) {
+    var rest []string
+    for {
+        if err := fs.Parse(args); err != nil {
+            return nil, err
+        }
+        args = fs.Args()
+        if len(args) == 0 {
+            return rest, nil
+        }
+        rest = append(rest, args[0])
+        args = args[1:]
+    }
+}
+
+func fail(err error) int {
+    fmt.Fprintln(os.Stderr, "bracket:", err)
+    return 1
+}
+
+// flags to set up a vm, shared by the commands
+type vmFlags struct {
+    prelude   string
+    noPrelude bool
+    trace     bool
+    maxSteps  int
+    seed      int64
+    arena     int
+    division  string
+    ieee      bool
+}
+
+func (f *vmFlags) register(fs *flag.FlagSet) {
+    fs.StringVar(&f.prelude, "prelude", "", "use this prelude instead of the built-in one")
+    fs.BoolVar(&f.noPrelude, "no-prelude", false, "start without prelude")
+    fs.BoolVar(&f.trace, "trace", false, "trace the evaluation")
+    fs.IntVar(&f.maxSteps, "max-steps", 0, "halt after this many steps (0: no limit)")
+    fs.Int64Var(&f.seed, "seed", 0, "seed of the random numbers (0: random)")
+    fs.IntVar(&f.arena, "arena", cells, "size of the arena in cells")
+    fs.StringVar(&f.division, "division", "zero", "result of a division by zero: zero, one, numerator or halt")
+    fs.BoolVar(&f.ieee, "ieee", false, "floats may be Inf and NaN instead of protected")
+}
+
+func (f *vmFlags) preludeCode() (string, error) {
+    if f.noPrelude {
+        return "", nil
+    }
+    return preludeSource(f.prelude)
+}
+
+func (f *vmFlags) newVm() (*Vm, error) {
+    if f.arena < 1024 {
+        return nil, fmt.Errorf("arena of %d cells is too small", f.arena)
+    }
+    v := newVm(f.arena)
+    return f.setup(&v)
+}
+
+// set up a new vm as given by the flags and load the prelude
+func (f *vmFlags) setup(vm *Vm) (*Vm, error) {
+    src, err := f.preludeCode()
+    if err != nil {
+        return nil, err
+    }
+    if err := vm.SetDivision(f.division); err != nil {
+        return nil, err
+    }
+    vm.SetIEEE(f.ieee)
+    vm.gcQuiet = !f.trace
+    if f.seed != 0 {
+        vm.rng.seed(f.seed)
+    }
+    if err := vm.loadPrelude(src); err != nil {
+        return nil, fmt.Errorf("prelude: %v", err)
+    }
+    vm.maxSteps = f.maxSteps
+    if f.trace {
+        vm.trace = 1
+    }
+    return vm, nil
+}
+
+// output formats of the ket
+func (vm *Vm) formatKet(format string) (string, error) {
+    switch format {
+    case "plain":
+        return vm.ketString(vm.ket), nil
+    case "ket":
+        return "[" + vm.ketString(vm.ket) + ">", nil
+    case "json":   // top first, like the other formats
+        b, err := vm.KetJSON(vm.ket)
+        return string(b), err
+    }
+    return "", fmt.Errorf("unknown output format %s", format)
+}
+
+// the ket a program starts with, given by the -ket flag (- reads stdin)
+// or by the arguments after the file, top first
+func (vm *Vm) inputKet(src string, args []string, format string, stdin io.Reader) (value, error) {
+    if src != "" && len(args) > 0 {
+        return nill, fmt.Errorf("ket given by -ket and by arguments")
+    }
+    if len(args) > 0 {
+        src = strings.Join(args, " ")
+    } else if src == "-" {
+        b, err := ioutil.ReadAll(stdin)
+        if err != nil {
+            return nill, err
+        }
+        src = string(b)
+    }
+    switch format {
+    case "plain":
+        return vm.ParseKet(src)
+    case "json":
+        if strings.TrimSpace(src) == "" {
+            return nill, nil
+        }
+        return vm.ParseKetJSON([]byte(src))
+    }
+    return nill, fmt.Errorf("unknown input format %s", format)
+}
+
+func cmdRun(args []string, stdin io.Reader, stdout io.Writer) int {
+    fs := flag.NewFlagSet("run", flag.ContinueOnError)
+    var vf vmFlags
+    vf.register(fs)
+    expr := fs.String("e", "", "evaluate code, after the file if one is given")
+    format := fs.String("o", "plain", "output format of the ket: plain, ket or json")
+    ket := fs.String("ket", "", "start with this ket, top first (- reads stdin)")
+    inFormat := fs.String("i", "plain", "input format of the ket: plain or json")
+    files, err := parseFlags(fs, args)
+    if err != nil {
+        return 2
+    }
+    if len(files) == 0 && *expr == "" {
+        fmt.Fprintln(os.Stderr, "usage: bracket run [flags] [file.clj] [ket elements]")
+        return 2
+    }
+    var kargs []string   // bracket file.clj 5 6
+    if len(files) > 1 {
+        files, kargs = files[:1], files[1:]
+    }
+    vm, err := vf.newVm()
+    if err != nil {
+        return fail(err)
+    }
+    if vm.ket, err = vm.inputKet(*ket, kargs, *inFormat, stdin); err != nil {
+        return fail(err)
+    }
+    if len(files) == 1 {
+        prog, err := vm.loadFile(files[0])
+        if err != nil {
+            return fail(err)
+        }
+        if isCell(prog) {   // an empty program would push []
+            vm.bra = prog
+            vm.evalBra()
+        }
+    }
+    if *expr != "" && vm.err == nil {
+        vm.bra = vm.makeBra(*expr)
+        vm.evalBra()
+    }
+    out, err := vm.formatKet(*format)
+    if err != nil {
+        return fail(err)
+    }
+    fmt.Fprintln(stdout, out)
+    if vm.err != nil {
+        return fail(vm.err)
+    }
+    return 0
+}
+
+// brackets opened but not yet closed, comments are skipped
+func openBrackets(s string) int {
+    n := 0
+    for _, line := range strings.Split(s, "\n") {
+        if i := strings.Index(line, ";"); i >= 0 {
+            line = line[:i]
+        }
+        n += strings.Count(line, "[") - strings.Count(line, "]")
+        n += strings.Count(line, "{") - strings.Count(line, "}")
+    }
+    return n
+}
+
+func cmdRepl(args []string, stdin io.Reader, stdout io.Writer) int {
+    fs := flag.NewFlagSet("repl", flag.ContinueOnError)
+    var vf vmFlags
+    vf.register(fs)
+    format := fs.String("o", "ket", "output format of the ket: plain, ket or json")
+    if _, err := parseFlags(fs, args); err != nil {
+        return 2
+    }
+    vm, err := vf.newVm()
+    if err != nil {
+        return fail(err)
+    }
+    in := bufio.NewScanner(stdin)
+    code := ""
+    fmt.Fprint(stdout, "> ")
+    for in.Scan() {
+        code += in.Text() + "\n"
+        if openBrackets(code) > 0 {   // continue on the next line
+            fmt.Fprint(stdout, ". ")
+            continue
+        }
+        vm.bra = vm.makeBra(code)
+        vm.evalBra()
+        code = ""
+        if vm.err != nil {
+            fmt.Fprintln(stdout, "error:", vm.err)
+            vm.err = nil
+        }
+        out, err := vm.formatKet(*format)
+        if err != nil {
+            return fail(err)
+        }
+        fmt.Fprintln(stdout, out)
+        fmt.Fprint(stdout, "> ")
+    }
+    fmt.Fprintln(stdout)
+    return 0
+}
+
+func cmdTest(args []string, stdout io.Writer) int {
+    fs := flag.NewFlagSet("test", flag.ContinueOnError)
+    var vf vmFlags
+    vf.register(fs)
+    files, err := parseFlags(fs, args)
+    if err != nil {
+        return 2
+    }
+    if len(files) == 0 {
+        files = []string{"tests"}
+    }
+    var vm *Vm
+    fresh := func() (*Vm, error) {
+        var err error
+        if vm == nil {
+            vm, err = vf.newVm()
+        } else {
+            v := vm.recycle()
+            vm, err = vf.setup(&v)
+        }
+        return vm, err
+    }
+    failed, err := runScripts(files, fresh, stdout)
+    if err != nil {
+        return fail(err)
+    }
+    if failed > 0 {
+        return 1
+    }
+    return 0
+}
+
+func cmdFmt(args []string, stdout io.Writer) int {
+    fs := flag.NewFlagSet("fmt", flag.ContinueOnError)
+    width := fs.Int("w", 80, "line width")
+    write := fs.Bool("write", false, "write the result back to the files")
+    files, err := parseFlags(fs, args)
+    if err != nil {
+        return 2
+    }
+    if len(files) == 0 {
+        fmt.Fprintln(os.Stderr, "usage: bracket fmt [-w width] [-write] files")
+        return 2
+    }
+    for _, f := range files {
+        path, err := findFile(f)
+        if err != nil {
+            return fail(err)
+        }
+        b, err := ioutil.ReadFile(path)
+        if err != nil {
+            return fail(err)
+        }
+        out := FormatSource(b, *width)
+        if *write {
+            err = ioutil.WriteFile(path, out, 0644)
+        } else {
+            _, err = stdout.Write(out)
+        }
+        if err != nil {
+            return fail(err)
+        }
+    }
+    return 0
+}
+
+func cmdCheck(args []string, stdout io.Writer) int {
+    fs := flag.NewFlagSet("check", flag.ContinueOnError)
+    var vf vmFlags
+    vf.register(fs)
+    expr := fs.String("e", "", "check code instead of a file")
+    depth := fs.Int("depth", 0, "elements on the ket at start")
+    files, err := parseFlags(fs, args)
+    if err != nil {
+        return 2
+    }
+    if len(files) != 1 && *expr == "" || len(files) > 0 && *expr != "" {
+        fmt.Fprintln(os.Stderr, "usage: bracket check [flags] file.clj")
+        return 2
+    }
+    vm, err := vf.newVm()
+    if err != nil {
+        return fail(err)
+    }
+    var prog value
+    if *expr != "" {
+        prog = vm.makeBra(*expr)
+    } else if prog, err = vm.loadFile(files[0]); err != nil {
+        return fail(err)
+    }
+    if !vm.check(prog, *depth, stdout) {
+        return 1
+    }
+    return 0
+}
+
+func cmdEvolve(args []string, stdout io.Writer) int {
+    fs := flag.NewFlagSet("evolve", flag.ContinueOnError)
+    opt := defaultEvolve
+    name := fs.String("problem", "square", "problem to solve")
+    list := fs.Bool("list", false, "list the problems")
+    fs.IntVar(&opt.PopSize, "pop", opt.PopSize, "population size")
+    fs.IntVar(&opt.Gens, "gens", opt.Gens, "number of generations")
+    fs.IntVar(&opt.Tournament, "tournament", opt.Tournament, "tournament size")
+    fs.IntVar(&opt.MaxLen, "max-len", opt.MaxLen, "maximal genome length in tokens")
+    fs.IntVar(&opt.MaxSteps, "max-steps", opt.MaxSteps, "step budget of each run")
+    fs.Int64Var(&opt.Seed, "seed", opt.Seed, "seed of the random numbers")
+    arena := fs.Int("arena", 1<<20, "size of the arena in cells")
+    quiet := fs.Bool("q", false, "do not print statistics of the generations")
+    if rest, err := parseFlags(fs, args); err != nil || len(rest) > 0 {
+        return 2
+    }
+    if *list {
+        for _, n := range problemNames() {
+            fmt.Fprintf(stdout, "%-12s %s\n", n, problems[n].Doc)
+        }
+        return 0
+    }
+    p, ok := problems[*name]
+    if !ok {
+        return fail(fmt.Errorf("unknown problem %s, known are %s", *name,
+            strings.Join(problemNames(), ", ")))
+    }
+    if opt.PopSize < 2 || opt.MaxLen < 2 || opt.Tournament < 1 || *arena < 1024 {
+        return fail(fmt.Errorf("bad settings of evolve"))
+    }
+    if !*quiet {
+        opt.Log = stdout
+    }
+    v := newVm(*arena)
+    vm := &v
+    vm.gcQuiet = true
+    best, e, err := vm.evolve(p, opt)
+    if err != nil {
+        return fail(err)
+    }
+    fmt.Fprintln(stdout, "error:", e)
+    fmt.Fprintln(stdout, "best:", best)
+    fmt.Fprintln(stdout, "simplified:", vm.simplifyGenome(p, best))
+    return 0
+}
@@ -0,0 +1,169 @@
+// floats
+// a float is an immediate value like an int, the bits of a float64 with
+// the lowest four bits of the mantissa taken by the tag, so floats have
+// a mantissa of 48 bits. Math on floats is protected, no primitive gives
+// Inf or NaN, unless the vm is set to IEEE floats with SetIEEE.
+// An int or big int meeting a float is converted to a float.
+package main
+
+import (
+    "math"
+    "math/big"
+    "regexp"
+    "strconv"
+    "strings"
+)
+
+// largest float, protected results are clipped to it
+var maxFloat = math.Float64frombits(0x7feffffffffffff0)
+
+// rounded to the nearest float with a mantissa of 48 bits
+func boxFloat(f float64) value {
+    if f == 0 {
+        f = 0   // no -0, eq compares the bits
+    }
+    return value((math.Float64bits(f) + 8) &^ tagMask | tagFloat)
+}
+
+func unboxFloat(x value) float64 {
+    return math.Float64frombits(uint64(x) &^ tagMask)
+}
+
+// int, big int or float
+func isNumber(x value) bool {return isNumb(x) || isBig(x)}
+
+func (vm *Vm) floatOf(x value) float64 {
+    switch {
+    case isFloat(x):
+        return unboxFloat(x)
+    case isBig(x):
+        f, _ := new(big.Float).SetInt(vm.bigOf(x)).Float64()
+        return f
+    }
+    return float64(unbox(x))
+}
+
+// float of f, Inf is clipped and NaN is 0 for protected floats
+func (vm *Vm) newFloat(f float64) value {
+    if !vm.ieee {
+        switch {
+        case math.IsNaN(f):
+            f = 0
+        case f > maxFloat:
+            f = maxFloat
+        case f < -maxFloat:
+            f = -maxFloat
+        }
+    }
+    return boxFloat(f)
+}
+
+// floats as IEEE 754 floats, which may be Inf and NaN, instead of protected
+func (vm *Vm) SetIEEE(on bool) {
+    vm.ieee = on
+}
+
+// op applied to floats, see arith
+func (vm *Vm) floatArith(op mathOp, x, y value) (value, bool) {
+    fx, fy := vm.floatOf(x), vm.floatOf(y)
+    switch {
+    case op.test != nil:
+        return truth(op.test(fx, fy)), true
+    case op.float == nil:   // e.g. bit-and
+        return nill, false
+    case op.div && fy == 0 && !vm.ieee:
+        r, ok := vm.divByZero(x)
+        if !ok {
+            return nill, false
+        }
+        return vm.newFloat(vm.floatOf(r)), true
+    case op.safe != nil && !vm.ieee:
+        return vm.newFloat(op.safe(fx, fy)), true
+    }
+    return vm.newFloat(op.float(fx, fy)), true
+}
+
+// reading and printing  ****************************
+
+// a number with a point or an exponent, ints are read first
+var floatToken = regexp.MustCompile(`^[+-]?([0-9]+\.[0-9]*|\.[0-9]+|[0-9]+)([eE][+-]?[0-9]+)?$`)
+
+// shortest text which reads back into the float x, with a point or an
+// exponent so that it is not read as an int
+func floatText(x value) string {
+    f := unboxFloat(x)
+    for p := 1; p < 17; p++ {
+        g, _ := strconv.ParseFloat(strconv.FormatFloat(f, 'g', p, 64), 64)
+        if boxFloat(g) == x {
+            f = g
+            break
+        }
+    }
+    s := strconv.FormatFloat(f, 'g', -1, 64)
+    if a := math.Abs(f); a >= 1e-4 && a < 1e21 {   // no exponent, as in JavaScript
+        s = strconv.FormatFloat(f, 'f', -1, 64)
+    }
+    if !strings.ContainsAny(s, ".eIN") {   // Inf and NaN are not read back
+        s += ".0"
+    }
+    return s
+}
+
+// math  ****************************************
+
+// protected, log |x| and 0 for 0 as in Koza's rlog
+func safeLog(x, _ float64) float64 {
+    if x == 0 {
+        return 0
+    }
+    return math.Log(math.Abs(x))
+}
+
+// protected, a negative x with a broken power y takes |x|
+func safePow(x, y float64) float64 {
+    if x < 0 && y != math.Trunc(y) {
+        x = -x
+    }
+    return math.Pow(x, y)
+}
+
+func float1(f func(float64) float64) func(x, _ float64) float64 {
+    return func(x, _ float64) float64 {return f(x)}
+}
+
+var opSin   = mathOp{float: float1(math.Sin)}
+var opCos   = mathOp{float: float1(math.Cos)}
+var opTan   = mathOp{float: float1(math.Tan)}
+var opAtan  = mathOp{float: float1(math.Atan)}
+var opTanh  = mathOp{float: float1(math.Tanh)}
+var opExp   = mathOp{float: float1(math.Exp)}
+var opLog   = mathOp{float: float1(math.Log), safe: safeLog}
+var opFloat = mathOp{float: func(x, _ float64) float64 {return x}}
+
+// int of a float, truncated and clipped to the ints, NaN gives 0
+var opInt = mathOp{any: func(x, _ value) (value, bool) {
+    switch {
+    case isInteger(x):
+        return x, true
+    case !isFloat(x):
+        return nill, false
+    }
+    f := unboxFloat(x)
+    switch {
+    case math.IsNaN(f):
+        return boxInt(0), true
+    case f >= maxInt:
+        return boxInt(maxInt), true
+    case f <= minInt:
+        return boxInt(minInt), true
+    }
+    return boxInt(int(f)), true
+}}
+
+// random float from 0 up to x (without x)
+func (vm *Vm) rndFloat(x float64) value {
+    if x > 0 {
+        return vm.newFloat(float64(vm.rng.next()>>11) / (1<<53) * x)
+    }
+    return boxFloat(0)
+}
@@ -0,0 +1,344 @@
+// formatter and pretty-printer for bracket code
+// code is laid out in the order of the source, nested quotations are
+// indented and lines are broken at a given width.
+// The formatter works on a tree of the tokens of the source, comments
+// included, so that comments and line breaks of the source survive.
+package main
+
+import (
+    "bytes"
+    "strconv"
+    "strings"
+)
+
+type node struct {
+    text    string   // atom or comment
+    kids    []*node
+    list    bool
+    brace   bool     // map {..} instead of list [..]
+    vec     bool     // vector #[..]
+    comment bool
+    pre     string   // glued to the front, e.g. \ of a lambda
+    post    string   // glued to the end, e.g. ' or `
+    brk     bool     // starts a new line in the source
+    blank   bool     // preceded by an empty line in the source
+    line    int      // line number in the source
+    size    int      // length on a single line, set by measure
+    flat    bool     // can be written on a single line, set by measure
+}
+
+// set size and flat of n and all nodes below
+func (n *node) measure() {
+    n.size = len(n.pre) + len(n.text) + len(n.post)
+    n.flat = !n.comment
+    if !n.list {
+        return
+    }
+    open, close := n.brackets()
+    n.size += len(open) + len(close) + len(n.kids)   // brackets and spaces
+    if len(n.kids) > 0 {
+        n.size--
+    }
+    for _, k := range n.kids {
+        k.measure()
+        n.size += k.size
+        n.flat = n.flat && k.flat && !k.brk
+    }
+}
+
+func (n *node) brackets() (string, string) {
+    if n.brace {
+        return "{", "}"
+    }
+    if n.vec {
+        return "#[", "]"
+    }
+    return "[", "]"
+}
+
+func (n *node) String() string {
+    if !n.list {
+        return n.pre + n.text + n.post
+    }
+    s := make([]string, len(n.kids))
+    for i, k := range n.kids {
+        s[i] = k.String()
+    }
+    open, close := n.brackets()
+    return n.pre + open + strings.Join(s, " ") + close + n.post
+}
+
+// source text to nodes  ****************************
+
+type srcReader struct {
+    toks []token
+    pos  int
+}
+
+func newSrcReader(src []byte) *srcReader {
+    return &srcReader{toks: scan(src, true)}
+}
+
+// the next token is a [ right after the current one, e.g. #[ or \[
+func (r *srcReader) gluedList() bool {
+    return r.pos < len(r.toks) && r.toks[r.pos].glued && r.toks[r.pos].text == "["
+}
+
+// the next token continues the current atom, e.g. x'y
+func (r *srcReader) glued() bool {
+    if r.pos == len(r.toks) {
+        return false
+    }
+    t := r.toks[r.pos]
+    return t.glued && !t.comment && !strings.Contains("[]{}", t.text)
+}
+
+// read nodes up to the closing bracket of a list, or up to the end
+func (r *srcReader) nodes(top bool) []*node {
+    var ns []*node
+    pre := ""
+    newlines := 0
+    if top {
+        newlines = 1
+    }
+    for r.pos < len(r.toks) {
+        t := r.toks[r.pos]
+        r.pos++
+        newlines += t.newlines
+        var n *node
+        switch {
+        case t.comment:
+            n = &node{text: t.text, comment: true}
+        case (t.text == "]" || t.text == "}") && !top:
+            return ns
+        case t.text == "[":
+            n = &node{list: true}
+            n.kids = r.nodes(false)
+        case t.text == "{":
+            n = &node{list: true, brace: true}
+            n.kids = r.nodes(false)
+        default:   // a stray ] or } at the top is kept as it is
+            text := t.text
+            for r.glued() {
+                text += r.toks[r.pos].text
+                r.pos++
+            }
+            n = &node{text: text}
+            if text == "#" && r.gluedList() {
+                r.pos++
+                n = &node{list: true, vec: true}
+                n.kids = r.nodes(false)
+            }
+        }
+        n.line = t.line
+        n.brk = newlines > 0
+        n.blank = newlines > 1 && len(ns) > 0
+        nl := newlines
+        newlines = 0
+        if !n.comment && !n.list && len(ns) > 0 && !ns[len(ns)-1].comment &&
+            (n.text[0] == '\'' || n.text[0] == '`') && !n.brk {
+            ns[len(ns)-1].post += n.text   // escape of a list, e.g. [x]'
+            continue
+        }
+        if !n.comment && pre != "" {
+            n.pre, pre = pre, ""
+        }
+        if !n.comment && !n.list && strings.HasSuffix(n.text, "\\") && r.gluedList() {
+            pre = n.text   // lambda, e.g. \[x]
+            newlines = nl
+            continue
+        }
+        ns = append(ns, n)
+    }
+    return ns
+}
+
+// values to nodes  ************************************
+
+func (vm *Vm) valueNode(q value) *node {
+    vm.stripClosure(&q)
+    switch {
+    case isNil(q):
+        return &node{text: "[]"}
+    case isInt(q):
+        return &node{text: strconv.Itoa(unbox(q))}
+    case isBig(q):
+        return &node{text: vm.bigOf(q).String()}
+    case isFloat(q):
+        return &node{text: floatText(q)}
+    case isPrim(q):
+        return &node{text: vm.primName(q)}
+    case isSymb(q):
+        return &node{text: vm.symbolText(q)}
+    case isMap(q):   // keys and values in the order of the trie
+        n := &node{list: true, brace: true}
+        vm.mapWalk(vm.mapRoot(q), func(e value) {
+            n.kids = append(n.kids, vm.valueNode(vm.car(e)), vm.valueNode(vm.cdr(e)))
+        })
+        return n
+    case isVec(q):
+        n := &node{list: true, vec: true}
+        for i := 0; i < vm.vecLen(q); i++ {
+            n.kids = append(n.kids, vm.valueNode(vm.vecAt(q, i)))
+        }
+        return n
+    }
+    n := &node{list: true}
+    l, isDotted := vm.reverse(q)   // source order
+    var p value
+    pre := ""
+    if isDotted && vm.pop(&l, &p) {   // the tail comes first, [tail . elements]
+        n.kids = append(n.kids, vm.valueNode(p), &node{text: "."})
+    }
+    for vm.pop(&l, &p) {
+        if isPrim(p) {
+            p = plainPrim(p)
+        }
+        k := len(n.kids)
+        switch {
+        case (p == esc || p == vesc) && k > 0 && pre == "" && n.kids[k-1].text != ".":
+            if p == esc {
+                n.kids[k-1].post += "'"
+            } else {
+                n.kids[k-1].post += "`"
+            }
+            continue
+        case p == lambda && isDef(l) && pre == "":
+            pre = "\\"
+            continue
+        }
+        e := vm.valueNode(p)
+        e.pre, pre = pre, ""
+        n.kids = append(n.kids, e)
+    }
+    if isDef(l) {   // dotted list
+        n.kids = append(n.kids, &node{text: "."}, vm.valueNode(l))
+    }
+    return n
+}
+
+// name of a symbol as it must be written to parse back into the symbol
+// characters outside of the symbol alphabet are ignored by the parser,
+// so a leading ? keeps names like 1 or dup apart from numbers and primitives
+func (vm *Vm) symbolText(q value) string {
+    s := symbol2string(q)
+    if p, _ := vm.parse([]byte(s)); s == "" || p != q {
+        return "?" + s
+    }
+    return s
+}
+
+// layout  ********************************************
+
+type layout struct {
+    buf     bytes.Buffer
+    width   int
+    col     int
+    ind     int    // indentation of the current line
+    fresh   bool   // nothing written on the current line yet
+    needNL  bool   // next node must start on a new line
+}
+
+func (p *layout) newline(ind int) {
+    p.buf.WriteByte('\n')
+    p.buf.WriteString(strings.Repeat(" ", ind))
+    p.col, p.ind, p.fresh, p.needNL = ind, ind, true, false
+}
+
+func (p *layout) write(s string) {
+    if !p.fresh {
+        p.buf.WriteByte(' ')
+        p.col++
+    }
+    p.buf.WriteString(s)
+    p.col += len(s)
+    p.fresh = false
+}
+
+// write n on the current line
+func (p *layout) writeFlat(n *node) {
+    if !n.list {
+        p.write(n.pre + n.text + n.post)
+        return
+    }
+    open, close := n.brackets()
+    p.write(n.pre + open)
+    p.fresh = true
+    for _, k := range n.kids {
+        p.writeFlat(k)
+    }
+    p.buf.WriteString(close + n.post)
+    p.col += 1 + len(n.post)
+    p.fresh = false
+}
+
+// lay out nodes, continuation lines are indented by ind
+func (p *layout) nodes(ns []*node, ind int) {
+    for _, n := range ns {
+        if n.comment && !n.brk && !p.fresh {   // trailing comment
+            p.write(n.text)
+            p.needNL = true
+            continue
+        }
+        if n.blank && !p.fresh {
+            p.buf.WriteByte('\n')
+        }
+        if (n.brk || p.needNL) && !p.fresh {
+            p.newline(ind)
+        }
+        if n.comment {
+            p.write(n.text)
+            p.needNL = true
+            continue
+        }
+        sp := 1
+        if p.fresh {
+            sp = 0
+        }
+        if n.flat && (p.col + sp + n.size <= p.width || !n.list && p.fresh) {
+            p.writeFlat(n)
+            continue
+        }
+        if !n.list || n.flat && n.size <= p.width - ind {
+            if !p.fresh {
+                p.newline(ind)
+            }
+            p.writeFlat(n)
+            continue
+        }
+        // list over several lines
+        outer := p.ind
+        open, close := n.brackets()
+        p.write(n.pre + open)
+        p.needNL = true
+        p.nodes(n.kids, outer + 2)
+        p.newline(outer)
+        p.buf.WriteString(close + n.post)
+        p.col += 1 + len(n.post)
+        p.fresh = false
+    }
+}
+
+func render(ns []*node, width int) string {
+    p := layout{width: width, fresh: true}
+    for _, n := range ns {
+        n.measure()
+    }
+    p.nodes(ns, 0)
+    return p.buf.String()
+}
+
+// pretty-print a value, lines are broken at width
+// the output parses back into an equal value
+func (vm *Vm) PrettyPrint(q value, width int) string {
+    return render([]*node{vm.valueNode(q)}, width)
+}
+
+// format source code, keeping comments and the line breaks of the source
+func FormatSource(src []byte, width int) []byte {
+    out := render(newSrcReader(src).nodes(true), width)
+    if out == "" {
+        return nil
+    }
+    return []byte(out + "\n")
+}
@@ -0,0 +1,328 @@
+// genetic programming with bracket
+// genomes are token sequences, any sequence is a valid program.
+// Evolution is generational with tournament selection, one-point
+// crossover and point, insert and delete mutations.
+package main
+
+import (
+    "fmt"
+    "io"
+    "math"
+    "sort"
+    "strconv"
+    "strings"
+)
+
+// a fitness case: ket before the run (top first) and expected top after
+type Case struct {
+    In  []int
+    Out int
+}
+
+// a problem to be solved by evolution
+// either Cases or Fitness must be given, Fitness overrides Cases
+type Problem struct {
+    Name     string
+    Doc      string
+    PrimSet  string    // primitive set for the genomes, "" = full
+    Consts   []int     // integer constants available to the genomes
+    Vars     []string  // names bound to the inputs of a case, else they are pushed
+    Cases    []Case
+    Fitness  func(vm *Vm, prog value) float64  // error, 0 is a perfect solution
+    Setup    func(vm *Vm) error   // e.g. register primitives of the problem, they are added to PrimSet
+    MaxSteps int       // step budget per run, 0 = default
+}
+
+var problems = map[string]*Problem{}
+
+// make a problem known to bracket evolve
+func RegisterProblem(p *Problem) {
+    problems[p.Name] = p
+}
+
+func problemNames() []string {
+    var names []string
+    for n := range problems {
+        names = append(names, n)
+    }
+    sort.Strings(names)
+    return names
+}
+
+func init() {
+    var cases []Case
+    for x := -5; x <= 5; x++ {
+        cases = append(cases, Case{[]int{x}, x*x + 1})
+    }
+    RegisterProblem(&Problem{Name: "square", Doc: "x*x + 1 for x in -5..5",
+        PrimSet: "arith", Consts: []int{0, 1, 2}, Cases: cases})
+}
+
+// penalty for a case where no number is left on the ket
+const missPenalty = 1000
+
+// run prog for one case, starting afresh, with the inputs in bound to vars
+// or pushed on the ket (top first) if there are no vars
+// returns the top of the ket, ok is false after an error or for an empty ket
+// prog must be protected by the caller, the inputs must not be cells
+func (vm *Vm) runInputs(prog value, vars []string, in []value) (value, bool) {
+    vm.env = vm.mcons(nill, nill)
+    vm.ket = nill
+    for i := len(in)-1; i >= 0; i-- {
+        if vars != nil {
+            vm.bindKey(string2symbol(vars[i]), in[i])
+        } else {
+            vm.ket = vm.cons(in[i], vm.ket)
+        }
+    }
+    vm.bra = prog
+    vm.evalBra()
+    ok := vm.err == nil && isCell(vm.ket)
+    vm.err = nil
+    if !ok {
+        return nill, false
+    }
+    return vm.car(vm.ket), true
+}
+
+// sum of absolute errors over the fitness cases
+func (vm *Vm) caseError(p *Problem, prog value) float64 {
+    err := 0.0
+    mark := vm.protect(&prog)
+    defer vm.unprotect(mark)
+    for _, c := range p.Cases {
+        in := make([]value, len(c.In))
+        for i, x := range c.In {
+            in[i] = boxInt(x)
+        }
+        if top, ok := vm.runInputs(prog, p.Vars, in); !ok || !isNumber(top) {
+            err += missPenalty
+        } else {
+            err += math.Min(math.Abs(vm.floatOf(top) - float64(c.Out)), missPenalty)
+        }
+    }
+    return err
+}
+
+type genome []string
+
+func (g genome) String() string {
+    return strings.Join(g, " ")
+}
+
+type individual struct {
+    g   genome
+    err float64
+}
+
+// settings of a run of evolve
+type EvolveOptions struct {
+    PopSize    int
+    Gens       int
+    Tournament int
+    MaxLen     int    // maximal number of tokens of a genome
+    MaxSteps   int
+    Seed       int64
+    Log        io.Writer   // statistics of each generation go here, nil for none
+}
+
+var defaultEvolve = EvolveOptions{PopSize: 500, Gens: 50, Tournament: 5,
+    MaxLen: 60, MaxSteps: 1000, Seed: 1}
+
+type evolver struct {
+    vm    *Vm
+    prob  *Problem
+    opt   EvolveOptions
+    rng   rng
+    alpha []string   // tokens genomes are made of
+}
+
+func (vm *Vm) newEvolver(p *Problem, opt EvolveOptions) (*evolver, error) {
+    if p.Setup != nil {
+        if err := p.Setup(vm); err != nil {
+            return nil, err
+        }
+    }
+    ps := p.PrimSet
+    if ps == "" {
+        ps = "full"
+    }
+    if err := vm.UsePrimSet(ps); err != nil {
+        return nil, err
+    }
+    if vm.primSet != nil && len(vm.userCodes) > 0 {   // add the primitives of Setup
+        names := append([]string{}, primSets[ps]...)
+        for n := range vm.userCodes {
+            names = append(names, n)
+        }
+        set, err := vm.NewPrimSet(ps, names...)
+        if err != nil {
+            return nil, err
+        }
+        vm.SetPrimSet(set)
+    }
+    e := &evolver{vm: vm, prob: p, opt: opt}
+    e.rng.seed(opt.Seed)
+    vm.rng.seed(opt.Seed)   // for rnd in the genomes
+    quotes := false
+    for _, q := range vm.ActivePrims() {
+        switch q {
+        case trace, print, gcstat:   // no use for evolved code
+            continue
+        case eval, dip, iff:
+            quotes = true
+        }
+        e.alpha = append(e.alpha, vm.primName(q))
+    }
+    for _, c := range p.Consts {
+        e.alpha = append(e.alpha, strconv.Itoa(c))
+    }
+    e.alpha = append(e.alpha, p.Vars...)
+    if quotes {
+        e.alpha = append(e.alpha, "[", "]")
+    }
+    return e, nil
+}
+
+func (e *evolver) token() string {
+    return e.alpha[e.rng.intn(len(e.alpha))]
+}
+
+func (e *evolver) random() genome {
+    g := make(genome, 1 + e.rng.intn(e.opt.MaxLen/2))
+    for i := range g {
+        g[i] = e.token()
+    }
+    return g
+}
+
+// error of genome g
+func (e *evolver) eval(g genome) float64 {
+    vm := e.vm
+    vm.reset()
+    vm.maxSteps = e.opt.MaxSteps
+    if e.prob.MaxSteps > 0 {
+        vm.maxSteps = e.prob.MaxSteps
+    }
+    prog := vm.makeBra(g.String())
+    if e.prob.Fitness != nil {
+        return e.prob.Fitness(vm, prog)
+    }
+    return vm.caseError(e.prob, prog)
+}
+
+func (e *evolver) tournament(pop []individual) individual {
+    best := pop[e.rng.intn(len(pop))]
+    for i := 1; i < e.opt.Tournament; i++ {
+        if c := pop[e.rng.intn(len(pop))]; c.err < best.err {
+            best = c
+        }
+    }
+    return best
+}
+
+func (e *evolver) crossover(a, b genome) genome {
+    i, j := e.rng.intn(len(a)+1), e.rng.intn(len(b)+1)
+    c := append(append(genome{}, a[:i]...), b[j:]...)
+    if len(c) > e.opt.MaxLen {
+        c = c[:e.opt.MaxLen]
+    }
+    return c
+}
+
+func (e *evolver) mutate(a genome) genome {
+    g := append(genome{}, a...)
+    i := e.rng.intn(len(g)+1)
+    switch e.rng.intn(3) {
+    case 0:   // point mutation
+        if i < len(g) {
+            g[i] = e.token()
+        }
+    case 1:   // insertion
+        if len(g) < e.opt.MaxLen {
+            g = append(g[:i], append(genome{e.token()}, g[i:]...)...)
+        }
+    default:  // deletion
+        if i < len(g) && len(g) > 1 {
+            g = append(g[:i], g[i+1:]...)
+        }
+    }
+    return g
+}
+
+// source of genome g simplified, on the vm that evolved it, so that the
+// primitive set and the settings of p hold, or of g itself if the
+// simplified program gives another ket for a case, or another error
+func (vm *Vm) simplifyGenome(p *Problem, g genome) string {
+    vm.reset()
+    prog := vm.makeBra(g.String())
+    simple := vm.simplify(prog)
+    mark := vm.protect(&prog, &simple)
+    defer vm.unprotect(mark)
+    for _, c := range p.Cases {
+        in := make([]value, len(c.In))
+        for i, x := range c.In {
+            in[i] = boxInt(x)
+        }
+        _, ok := vm.runInputs(prog, p.Vars, in)
+        k := vm.ket
+        kmark := vm.protect(&k)
+        _, simpleOk := vm.runInputs(simple, p.Vars, in)
+        same := ok == simpleOk && vm.isEqual(k, vm.ket)
+        vm.unprotect(kmark)
+        if !same {
+            return g.String()
+        }
+    }
+    if p.Fitness != nil && p.Fitness(vm, simple) != p.Fitness(vm, prog) {
+        return g.String()
+    }
+    s := vm.PrettyPrint(simple, 1<<30)
+    return s[1:len(s)-1]
+}
+
+// evolve a solution of problem p, returns the best genome and its error
+func (vm *Vm) evolve(p *Problem, opt EvolveOptions) (genome, float64, error) {
+    e, err := vm.newEvolver(p, opt)
+    if err != nil {
+        return nil, 0, err
+    }
+    pop := make([]individual, opt.PopSize)
+    for i := range pop {
+        g := e.random()
+        pop[i] = individual{g, e.eval(g)}
+    }
+    best := pop[0]
+    for gen := 0; ; gen++ {
+        sum := 0.0
+        for _, ind := range pop {
+            sum += ind.err
+            // shorter genomes win ties
+            if ind.err < best.err || ind.err == best.err && len(ind.g) < len(best.g) {
+                best = ind
+            }
+        }
+        if opt.Log != nil {
+            fmt.Fprintf(opt.Log, "gen %d  best %g  mean %.1f  size %d\n", gen, best.err,
+                sum/float64(len(pop)), len(best.g))
+        }
+        if best.err == 0 || gen == opt.Gens {
+            break
+        }
+        next := []individual{best}   // elitism
+        for len(next) < len(pop) {
+            var g genome
+            if e.rng.intn(10) < 7 {
+                g = e.crossover(e.tournament(pop).g, e.tournament(pop).g)
+            } else {
+                g = e.mutate(e.tournament(pop).g)
+            }
+            if len(g) == 0 {
+                g = e.random()
+            }
+            next = append(next, individual{g, e.eval(g)})
+        }
+        pop = next
+    }
+    return best.g, best.err, nil
+}
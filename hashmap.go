@@ -0,0 +1,307 @@
+// persistent hash maps
+// a map is a binary hash trie in cells of the arena, so the gc moves
+// maps like lists. Maps are never changed, assoc and dissoc copy the
+// path to the changed entry and share the rest with the old map.
+//   map      pointer with tagMap to the header cell (count . root)
+//   root     nill for the empty map, a bucket or a branch
+//   branch   pointer with tagMap to (left . right), bit d of the hash
+//            of a key chooses the side at depth d
+//   bucket   list of entries (key . value), all keys have the same hash
+// keys are compared with isEqual, so closures count as their code
+package main
+
+const hashBits = 64   // depth of the trie at most
+
+// bits of a value are spread over the hash (splitmix64)
+func mix(h uint64) uint64 {
+    h ^= h >> 30
+    h *= 0xbf58476d1ce4e5b9
+    h ^= h >> 27
+    h *= 0x94d049bb133111eb
+    return h ^ h>>31
+}
+
+// hash of a value, equal values by isEqual have equal hashes
+func (vm *Vm) hash(x value) uint64 {
+    h := uint64(0)
+    for vm.stripClosure(&x); isCell(x); vm.stripClosure(&x) {
+        h = mix(h + vm.hash(vm.car(x)))
+        x = vm.cdr(x)
+    }
+    if isMap(x) {   // independent of the order of the entries
+        s := uint64(tagMap)
+        vm.mapWalk(vm.mapRoot(x), func(e value) {
+            s += mix(vm.hash(vm.car(e)) + 31*vm.hash(vm.cdr(e)))
+        })
+        return mix(h ^ s)
+    }
+    if isBlock(x) {   // vector or big int, the kind tells them apart
+        s := uint64(x & tagMask)
+        if isBig(x) {   // the sign
+            s += 31*uint64(vm.cdr(x))
+        }
+        for i := 0; i < vm.vecLen(x); i++ {
+            s = mix(s + vm.hash(vm.vecAt(x, i)))
+        }
+        return mix(h ^ s)
+    }
+    return mix(h ^ uint64(x))
+}
+
+func hashBit(h uint64, d int) bool {return h>>uint(d) & 1 == 1}
+
+// [] is taken as the empty map
+func (vm *Vm) mapCount(m value) int {
+    if isMap(m) {
+        return unbox(vm.car(m))
+    }
+    return 0
+}
+
+func (vm *Vm) mapRoot(m value) value {
+    if isMap(m) {
+        return vm.cdr(m)
+    }
+    return nill
+}
+
+func (vm *Vm) newMap(n int, root value) value {
+    return boxMap(vm.makeCons(boxInt(n), root))
+}
+
+func (vm *Vm) branch(l, r value) value {
+    return boxMap(vm.makeCons(l, r))
+}
+
+// the bucket where key with hash h is or would be
+func (vm *Vm) bucket(node value, h uint64) value {
+    for d := 0; isMap(node); d++ {
+        if hashBit(h, d) {
+            node = vm.cdr(node)
+        } else {
+            node = vm.car(node)
+        }
+    }
+    return node
+}
+
+// value of key k in map m
+func (vm *Vm) mapGet(m, k value) (value, bool) {
+    for b := vm.bucket(vm.mapRoot(m), vm.hash(k)); isCons(b); b = vm.cdr(b) {
+        if e := vm.car(b); vm.isEqual(vm.car(e), k) {
+            return vm.cdr(e), true
+        }
+    }
+    return nill, false
+}
+
+// call f for each entry of the trie below node
+func (vm *Vm) mapWalk(node value, f func(e value)) {
+    if isMap(node) {
+        vm.mapWalk(vm.car(node), f)
+        vm.mapWalk(vm.cdr(node), f)
+        return
+    }
+    for ; isCons(node); node = vm.cdr(node) {
+        f(vm.car(node))
+    }
+}
+
+// bucket b without the entry of key k
+func (vm *Vm) without(b, k value) (value, bool) {
+    if !isCons(b) {
+        return b, false
+    }
+    e := vm.car(b)
+    if vm.isEqual(vm.car(e), k) {
+        return vm.cdr(b), true
+    }
+    r, found := vm.without(vm.cdr(b), k)
+    if !found {
+        return b, false
+    }
+    return vm.cons(e, r), true
+}
+
+// branches down to the first bit where the hashes of buckets a and b differ
+func (vm *Vm) split(a value, ha uint64, b value, hb uint64, d int) value {
+    switch {
+    case hashBit(ha, d) == hashBit(hb, d) && hashBit(ha, d):
+        return vm.branch(nill, vm.split(a, ha, b, hb, d+1))
+    case hashBit(ha, d) == hashBit(hb, d):
+        return vm.branch(vm.split(a, ha, b, hb, d+1), nill)
+    case hashBit(ha, d):
+        return vm.branch(b, a)
+    }
+    return vm.branch(a, b)
+}
+
+// trie below node with k set to v, added is false if k was there already
+func (vm *Vm) insert(node value, d int, h uint64, k, v value) (value, bool) {
+    if isMap(node) {
+        if hashBit(h, d) {
+            r, added := vm.insert(vm.cdr(node), d+1, h, k, v)
+            return vm.branch(vm.car(node), r), added
+        }
+        l, added := vm.insert(vm.car(node), d+1, h, k, v)
+        return vm.branch(l, vm.cdr(node)), added
+    }
+    e := vm.cons(k, v)
+    if isNil(node) {
+        return vm.cons(e, nill), true
+    }
+    if hb := vm.hash(vm.caar(node)); hb != h {
+        return vm.split(node, hb, vm.cons(e, nill), h, d), true
+    }
+    rest, found := vm.without(node, k)
+    return vm.cons(e, rest), !found
+}
+
+// trie below node without k, a bucket left alone in a branch moves up
+func (vm *Vm) remove(node value, d int, h uint64, k value) (value, bool) {
+    if !isMap(node) {
+        return vm.without(node, k)
+    }
+    l, r := vm.car(node), vm.cdr(node)
+    var found bool
+    if hashBit(h, d) {
+        r, found = vm.remove(r, d+1, h, k)
+    } else {
+        l, found = vm.remove(l, d+1, h, k)
+    }
+    switch {
+    case !found:
+        return node, false
+    case isNil(l) && !isMap(r):
+        return r, true
+    case isNil(r) && !isMap(l):
+        return l, true
+    }
+    return vm.branch(l, r), true
+}
+
+// map m with k set to v
+// assoc and dissoc do not run the gc, see reserve
+func (vm *Vm) mapAssoc(m, k, v value) value {
+    root, added := vm.insert(vm.mapRoot(m), 0, vm.hash(k), k, v)
+    n := vm.mapCount(m)
+    if added {
+        n++
+    }
+    return vm.newMap(n, root)
+}
+
+// map m without k, m itself if k is not in m
+func (vm *Vm) mapDissoc(m, k value) value {
+    root, found := vm.remove(vm.mapRoot(m), 0, vm.hash(k), k)
+    if !found {
+        return m
+    }
+    return vm.newMap(vm.mapCount(m)-1, root)
+}
+
+func (vm *Vm) mapEqual(m1, m2 value) bool {
+    if vm.mapCount(m1) != vm.mapCount(m2) {
+        return false
+    }
+    eq := true
+    vm.mapWalk(vm.mapRoot(m1), func(e value) {
+        v, ok := vm.mapGet(m2, vm.car(e))
+        eq = eq && ok && vm.isEqual(v, vm.cdr(e))
+    })
+    return eq
+}
+
+// map from the keys and values of l in source order, {a 1 b 2}
+// a key without value gets []
+func (vm *Vm) mapFromList(l value) value {
+    var kv []value
+    for ; isCons(l); l = vm.cdr(l) {   // l ends with the first element
+        kv = append(kv, vm.car(l))
+    }
+    if len(kv) % 2 == 1 {
+        kv = append([]value{nill}, kv...)
+    }
+    root, n := nill, 0
+    for i := len(kv)-1; i > 0; i -= 2 {   // no header for each step
+        var added bool
+        root, added = vm.insert(root, 0, vm.hash(kv[i]), kv[i], kv[i-1])
+        if added {
+            n++
+        }
+    }
+    return vm.newMap(n, root)
+}
+
+// primitives  ********************************
+// a map argument can also be a symbol bound to a map, like the lists of
+// the list primitives. Arguments that are no maps are consumed and
+// nothing is pushed
+
+func (vm *Vm) mapArg(p *value) bool {
+    if isSymb(*p) {
+        *p = vm.boundvalue(*p)
+    }
+    return isMap(*p) || isNil(*p)
+}
+
+// cells needed to change the entry of k, at most two branches per bit
+func (vm *Vm) mapNeed(m, k value) int {
+    return 2*hashBits + vm.length(vm.bucket(vm.mapRoot(m), vm.hash(k))) + 4
+}
+
+// assoc k v m, e.g. assoc b' 2 {a 1} gives {a 1 b 2}
+func (vm *Vm) fAssoc() {
+    var k, v, m value
+    if vm.pop2(&vm.ket, &k, &v) && vm.pop(&vm.ket, &m) && vm.mapArg(&m) {
+        mark := vm.protect(&k, &v, &m)
+        vm.reserve(vm.mapNeed(m, k))
+        vm.unprotect(mark)
+        vm.ket = vm.cons(vm.mapAssoc(m, k, v), vm.ket)
+    }
+}
+
+// get k m gives [] if k is not in m, see has
+func (vm *Vm) fGet() {
+    var k, m value
+    if vm.pop2(&vm.ket, &k, &m) && vm.mapArg(&m) {
+        v, _ := vm.mapGet(m, k)
+        vm.ket = vm.cons(v, vm.ket)
+    }
+}
+
+func (vm *Vm) fHas() {
+    var k, m value
+    if vm.pop2(&vm.ket, &k, &m) && vm.mapArg(&m) {
+        t := 0
+        if _, ok := vm.mapGet(m, k); ok {
+            t = 1
+        }
+        vm.ket = vm.cons(boxInt(t), vm.ket)
+    }
+}
+
+func (vm *Vm) fDissoc() {
+    var k, m value
+    if vm.pop2(&vm.ket, &k, &m) && vm.mapArg(&m) {
+        mark := vm.protect(&k, &m)
+        vm.reserve(vm.mapNeed(m, k))
+        vm.unprotect(mark)
+        vm.ket = vm.cons(vm.mapDissoc(m, k), vm.ket)
+    }
+}
+
+// the keys in the order of the trie, which is the order maps are printed
+func (vm *Vm) fKeys() {
+    var m value
+    if vm.pop(&vm.ket, &m) && vm.mapArg(&m) {
+        mark := vm.protect(&m)
+        vm.reserve(vm.mapCount(m) + 1)
+        vm.unprotect(mark)
+        l := nill
+        vm.mapWalk(vm.mapRoot(m), func(e value) {
+            l = vm.cons(vm.car(e), l)
+        })
+        vm.ket = vm.cons(l, vm.ket)
+    }
+}
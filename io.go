@@ -5,11 +5,22 @@ package main
 import (
     "fmt"
     "bytes"
+    _ "embed"
     "errors"
     "io/ioutil"
+    "math/big"
+    "os"
+    "path/filepath"
     "strconv"
+    "strings"
+    "unicode"
+    "unicode/utf8"
 )
 
+// the prelude is built into the binary, so bracket runs from any directory
+//go:embed prelude.clj
+var preludeSrc string
+
 /* compared to Base64 we place the digits at the beginning 
 and use 'minus' and 'underscore' as additional chars  
 0..9 have position 0..9, 'A' .. 'Z' have position 10..35
@@ -64,14 +75,18 @@ func (vm *Vm) printElem(q value) {
    switch {
    case isInt(q):
        fmt.Print(unbox(q))
-   //case isFloat(q):
-   //    fmt.Print(unbox_float(q))
+   case isFloat(q):
+       fmt.Print(floatText(q))
    case isNil(q):
         fmt.Print("[]")
    case isPrim(q):
-        fmt.Print(primStr[q])
+        fmt.Print(vm.primName(q))
    case isSymb(q):
         fmt.Print(symbol2string(q))
+   case isBig(q):
+        fmt.Print(vm.bigOf(q))
+   case isMap(q) || isVec(q):
+        fmt.Print(vm.PrettyPrint(q, 1<<30))
    default:
         vm.printList(q)
    }
@@ -108,25 +123,33 @@ func (vm *Vm) printList(l value) {
       fmt.Print("]")
 }
 
+// the printed bra and ket are read back by ReadState
 func (vm *Vm) printKet(l value) {
-      fmt.Print("[")
-      vm.printInnerList(l,false)
-      fmt.Println(">")
+      fmt.Println("[" + vm.ketString(l) + ">")
 }
 
 func (vm *Vm) printBra(l value) {
-      fmt.Print("<")
-      vm.printInnerList(l,true)
-      fmt.Println("]")
+      fmt.Println("<" + vm.braString(l) + "]")
 }
 
-func parse(token []byte) (value, error) {
-    if n, err := strconv.Atoi(string(token)); err == nil {
+func (vm *Vm) parse(token []byte) (value, error) {
+    if n, err := strconv.Atoi(string(token)); err == nil && fits(n) {
       return boxInt(n), nil
-    } 
+    } else if err == nil || errors.Is(err, strconv.ErrRange) {  // more than 60 bits
+      if z, ok := new(big.Int).SetString(string(token), 10); ok {   // ErrRange comes before a bad digit
+          return vm.newBig(z), nil
+      }
+    }
+    if floatToken.Match(token) {
+      f, _ := strconv.ParseFloat(string(token), 64)   // too large gives Inf, see newFloat
+      return vm.newFloat(f), nil
+    }
+    if p,ok := vm.userCodes[string(token)]; ok && (vm.primSet == nil || vm.primSet.has(p)) {
+       return p | vm.libMark, nil   // token is a registered primitive
+    }
     p,ok := str2prim[string(token)]
-    if ok {
-       return p, nil   // token is a primitive
+    if ok && (vm.primSet == nil || vm.primSet.has(p)) {
+       return p | vm.libMark, nil   // token is a primitive
     } else {
        return string2symbol(string(token)), nil  // token is a symbol
     }
@@ -140,13 +163,30 @@ func (vm *Vm) readFromTokens(tokens [][]byte, pos int) (value, int) {
     token := tokens[pos]
     pos++
     switch string(token) { 
-    case "]" :
+    case "]", "}" :
       return s, pos
     case "[":
       s1, pos = vm.readFromTokens(tokens, pos)
       s = vm.cons(s1,s)
+    case "{":   // map literal, the elements are not evaluated
+      s1, pos = vm.readFromTokens(tokens, pos)
+      s = vm.cons(vm.mapFromList(s1),s)
+    case "#":   // vector literal #[..], the elements are not evaluated
+      if pos < len(tokens) && string(tokens[pos]) == "[" {
+          s1, pos = vm.readFromTokens(tokens, pos+1)
+          s = vm.cons(vm.vecFromList(s1),s)
+      } else {
+          p, _ := vm.parse(token)
+          s = vm.cons(p,s)
+      }
+    case ".":   // dotted list [tail . elements], as printed
+      if isCell(s) && isNil(vm.cdr(s)) && pos < len(tokens) && string(tokens[pos]) != "]" && string(tokens[pos]) != "}" {
+          s = vm.car(s)
+      } else {
+          s = vm.cons(string2symbol("."), s)
+      }
     default:
-      p,err := parse(token)
+      p,err := vm.parse(token)
       if err == nil {
           s = vm.cons(p,s)
        } else {
@@ -167,6 +207,8 @@ func removeComments (str []byte ) []byte {
            for str[i] != '\n' && i != l-1 {
               i += 1
            }
+           newstr[j] = ' '   // the comment separates tokens like the newline
+           j += 1
        case '\n':
           newstr[j] = ' '
           j += 1
@@ -178,26 +220,241 @@ func removeComments (str []byte ) []byte {
     return newstr[0:j]
 }
 
+// a token of the source
+type token struct {
+    text     string
+    line     int    // line of the source, from 1
+    newlines int    // line breaks since the token before
+    glued    bool   // no white space or comment since the token before
+    comment  bool   // from ; up to the end of the line
+}
+
+// tokens of their own even inside a word, the escapes are read as primitives
+var specialTokens = map[rune]string{'[': "[", ']': "]", '{': "{", '}': "}",
+    '\'': "esc", '`': "vesc", '\\': "lambda"}
+
+// split the source into tokens, the text of an escape is kept as in the
+// source. Comments separate tokens like white space, and are tokens
+// themselves if comments is true (for the formatter)
+func scan(src []byte, comments bool) []token {
+    var ts []token
+    line, newlines, glued := 1, 0, false
+    word := -1   // start of the current word
+    endWord := func(end int) {
+        if word >= 0 {
+            ts = append(ts, token{text: string(src[word:end]), line: line, newlines: newlines, glued: glued})
+            word, newlines, glued = -1, 0, true
+        }
+    }
+    for i := 0; i < len(src); {
+        r, n := utf8.DecodeRune(src[i:])
+        switch {
+        case r == ';':
+            endWord(i)
+            j := bytes.IndexByte(src[i:], '\n')
+            if j < 0 {
+                j = len(src) - i
+            }
+            if comments {
+                ts = append(ts, token{text: strings.TrimRight(string(src[i:i+j]), " \t\r"),
+                    line: line, newlines: newlines, comment: true})
+                newlines = 0
+            }
+            glued = false
+            i += j
+            continue
+        case unicode.IsSpace(r):
+            endWord(i)
+            if r == '\n' {
+                line++
+                newlines++
+            }
+            glued = false
+        case specialTokens[r] != "":
+            endWord(i)
+            ts = append(ts, token{text: string(src[i:i+n]), line: line, newlines: newlines, glued: glued})
+            newlines, glued = 0, true
+        case word < 0:
+            word = i
+        }
+        i += n
+    }
+    endWord(len(src))
+    return ts
+}
+
 func tokenize(str []byte) [][]byte {
-   str = bytes.ReplaceAll(str, []byte("["), []byte(" [ "))
-   str = bytes.ReplaceAll(str, []byte("]"), []byte(" ] "))
-   str = bytes.ReplaceAll(str, []byte("'"), []byte(" esc "))
-   str = bytes.ReplaceAll(str, []byte("`"), []byte(" vesc "))
-   str = bytes.ReplaceAll(str, []byte("\\"), []byte(" lambda "))
-   str = removeComments(str)
-   return bytes.Fields(str)
+    var ts [][]byte
+    for _, t := range scan(str, false) {
+        r, _ := utf8.DecodeRuneInString(t.text)
+        if special := specialTokens[r]; special != "" {
+            ts = append(ts, []byte(special))
+        } else {
+            ts = append(ts, []byte(t.text))
+        }
+    }
+    return ts
 }
 
 func (vm *Vm) makeBra(prog string) value {
-    tokens := tokenize([]byte(prog))
-    val,_ := vm.readFromTokens(tokens, 0)
-    return val
+    return vm.readTokens(tokenize([]byte(prog)))
 }
 
-func (vm *Vm) loadFile(fname string) value{
-    b, _ := ioutil.ReadFile(fname)
-    tokens := tokenize(b)
-    val,_ := vm.readFromTokens(tokens, 0)
+// a source too large for the arena halts the vm, as in evalBra
+func (vm *Vm) readTokens(tokens [][]byte) (val value) {
+    defer func() {
+        if r := recover(); r != nil {
+            err, ok := r.(vmError)
+            if !ok {
+                panic(r)
+            }
+            vm.halt(err)
+            val = nill
+        }
+    }()
+    val,_ = vm.readFromTokens(tokens, 0)
     return val
 }
 
+// find a source file: relative names are looked up in the working
+// directory first, then in the directories listed in BRACKET_PATH
+func findFile(fname string) (string, error) {
+    if _, err := os.Stat(fname); err == nil || filepath.IsAbs(fname) {
+        return fname, err
+    }
+    for _, dir := range filepath.SplitList(os.Getenv("BRACKET_PATH")) {
+        path := filepath.Join(dir, fname)
+        if _, err := os.Stat(path); err == nil {
+            return path, nil
+        }
+    }
+    return "", fmt.Errorf("%s not found in working directory or BRACKET_PATH", fname)
+}
+
+func readSource(fname string) ([]byte, error) {
+    path, err := findFile(fname)
+    if err != nil {
+        return nil, err
+    }
+    return ioutil.ReadFile(path)
+}
+
+func (vm *Vm) loadFile(fname string) (value, error) {
+    b, err := readSource(fname)
+    if err != nil {
+        return nill, err
+    }
+    return vm.readTokens(tokenize(b)), nil
+}
+
+// source of the prelude, "" is the prelude built into the binary
+func preludeSource(fname string) (string, error) {
+    if fname == "" {
+        return preludeSrc, nil
+    }
+    b, err := readSource(fname)
+    return string(b), err
+}
+
+// evaluate the prelude given by its source, it is read with all
+// primitives, which run as primitives of the prelude whatever the set
+func (vm *Vm) loadPrelude(src string) error {
+    ps := vm.primSet
+    vm.primSet, vm.libMark = nil, libPrim
+    vm.bra = vm.makeBra(src)
+    vm.primSet, vm.libMark = ps, 0
+    vm.evalBra()
+    vm.ket = nill
+    return vm.err
+}
+
+
+// input ket  ************************
+// a program can start with data on the ket, e.g. the inputs of a
+// fitness case. Kets are written top first, as they are printed
+
+// read the ket from source, elements are not evaluated
+// "5 [1 2] x" puts 5 on top of [1 2] and x
+func (vm *Vm) ParseKet(src string) (l value, err error) {
+    defer catchVmError(&err)
+    q, _ := vm.readFromTokens(tokenize([]byte(src)), 0)
+    l = nill
+    for ; isCell(q); q = vm.cdr(q) {  // the bra ends with the top
+        l = vm.cons(vm.car(q), l)
+    }
+    return l, nil
+}
+
+// put the elements of ket k on top of the ket, a ket too large
+// for the arena gives an error
+func (vm *Vm) PushKet(k value) (err error) {
+    defer catchVmError(&err)
+    l, _ := vm.reverse(k)
+    for ; isCell(l); l = vm.cdr(l) {
+        vm.ket = vm.cons(vm.car(l), vm.ket)
+    }
+    return nil
+}
+
+// Dirac notation  ************************
+// a state of the vm is written <bra|ket>, the bra as source and the
+// ket top first. <bra| and |ket> alone, and <bra] and [ket> as printed
+// by printBra and printKet are read as well
+
+// bra as source, without the brackets
+func (vm *Vm) braString(b value) string {
+    if !isCell(b) {
+        return ""
+    }
+    s := vm.PrettyPrint(b, 1<<30)
+    return s[1:len(s)-1]
+}
+
+func (vm *Vm) StateString(bra, ket value) string {
+    return "<" + vm.braString(bra) + "|" + vm.ketString(ket) + ">"
+}
+
+// read a state, the elements of the ket are not evaluated
+func (vm *Vm) ReadState(src string) (bra, ket value, err error) {
+    s := string(bytes.TrimSpace(removeComments([]byte(src))))
+    braSrc, ketSrc := "", ""
+    i := strings.IndexByte(s, '|')
+    switch {
+    case i >= 0 && (strings.HasPrefix(s, "<") || i == 0):
+        if i > 0 {
+            braSrc = s[1:i]
+        }
+        ketSrc = strings.TrimSpace(s[i+1:])
+        if ketSrc != "" {
+            if !strings.HasSuffix(ketSrc, ">") {
+                return nill, nill, errors.New("ket of state not closed by >")
+            }
+            ketSrc = ketSrc[:len(ketSrc)-1]
+        } else if i == 0 {
+            return nill, nill, errors.New("state | without ket")
+        }
+    case i < 0 && strings.HasPrefix(s, "<") && strings.HasSuffix(s, "]"):
+        braSrc = s[1:len(s)-1]
+    case i < 0 && strings.HasPrefix(s, "[") && strings.HasSuffix(s, ">"):
+        ketSrc = s[1:len(s)-1]
+    default:
+        return nill, nill, fmt.Errorf("%q is not a state <bra|ket>", src)
+    }
+    k, err := vm.ParseKet(ketSrc)
+    return vm.makeBra(braSrc), k, err
+}
+
+// evaluate a state, the resulting state is returned as written by StateString
+// e.g. "<dup 1 2|3>" gives "<|1 1 2 3>"
+func (vm *Vm) EvalState(src string) (string, error) {
+    bra, ket, err := vm.ReadState(src)
+    if err != nil {
+        return "", err
+    }
+    vm.ket = ket
+    if isCell(bra) {
+        vm.bra = bra
+        vm.evalBra()
+    }
+    return vm.StateString(nill, vm.ket), vm.err
+}
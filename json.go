@@ -0,0 +1,290 @@
+// conversion of bracket values to and from JSON
+// for tools written in other languages:
+//   ints         numbers, big ints as well
+//   floats       numbers with a point or an exponent, 1.0
+//   quotations   arrays in the order of the source, [] is nil
+//   symbols      strings with a quote in front, "'x"
+//   primitives   their name, "dup"
+//   closures     {"code": [..], "env": [{"x": 1}, ..]}
+//                frames of the captured bindings innermost first,
+//                the global frame is not written
+//   dotted lists {"list": [..], "tail": x}
+//   maps         {"map": [[key, value], ..]}
+//   vectors      {"vector": [..]}
+// a ket is an array with the top first
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "math"
+    "strings"
+)
+
+// value as JSON
+func (vm *Vm) EncodeJSON(v value) ([]byte, error) {
+    x, err := vm.toJSON(v, map[value]bool{})
+    if err != nil {
+        return nil, err
+    }
+    return json.Marshal(x)
+}
+
+// ket as JSON array, top first
+func (vm *Vm) KetJSON(k value) ([]byte, error) {
+    l := []interface{}{}
+    for ; isCons(k); k = vm.cdr(k) {
+        x, err := vm.toJSON(vm.car(k), map[value]bool{})
+        if err != nil {
+            return nil, err
+        }
+        l = append(l, x)
+    }
+    return json.Marshal(l)
+}
+
+// frames holds the frames of the closures being written, to find cycles
+func (vm *Vm) toJSON(v value, frames map[value]bool) (interface{}, error) {
+    switch {
+    case isNil(v):
+        return []interface{}{}, nil
+    case isInt(v):
+        return unbox(v), nil
+    case isBig(v):
+        return vm.bigOf(v), nil
+    case isFloat(v):
+        if f := unboxFloat(v); math.IsInf(f, 0) || math.IsNaN(f) {
+            return nil, errors.New("Inf and NaN are not supported")
+        }
+        return json.Number(floatText(v)), nil
+    case isPrim(v):
+        return vm.primName(v), nil
+    case isSymb(v):
+        return "'" + symbol2string(v), nil
+    case isClosure(v):
+        return vm.closureJSON(v, frames)
+    case isMap(v):
+        return vm.mapJSON(v, frames)
+    case isVec(v):
+        l := []interface{}{}
+        for i := 0; i < vm.vecLen(v); i++ {
+            x, err := vm.toJSON(vm.vecAt(v, i), frames)
+            if err != nil {
+                return nil, err
+            }
+            l = append(l, x)
+        }
+        return map[string]interface{}{"vector": l}, nil
+    }
+    l := []interface{}{}
+    for ; isCons(v); v = vm.cdr(v) {
+        x, err := vm.toJSON(vm.car(v), frames)
+        if err != nil {
+            return nil, err
+        }
+        l = append(l, x)
+    }
+    for i, j := 0, len(l)-1; i < j; i, j = i+1, j-1 {   // source order
+        l[i], l[j] = l[j], l[i]
+    }
+    if isNil(v) {
+        return l, nil
+    }
+    tail, err := vm.toJSON(v, frames)
+    if err != nil {
+        return nil, err
+    }
+    return map[string]interface{}{"list": l, "tail": tail}, nil
+}
+
+func (vm *Vm) closureJSON(c value, frames map[value]bool) (interface{}, error) {
+    code, err := vm.toJSON(vm.car(c), frames)
+    if err != nil {
+        return nil, err
+    }
+    env := []interface{}{}
+    for e := vm.cdr(c); isDef(e) && isDef(vm.cdr(e)); e = vm.cdr(e) {
+        if frames[e] {
+            return nil, errors.New("closure captures itself")
+        }
+        frames[e] = true
+        f := map[string]interface{}{}
+        for b := vm.car(e); isCell(b); b = vm.cdr(b) {
+            bnd := vm.car(b)
+            if f[symbol2string(vm.car(bnd))], err = vm.toJSON(vm.cdr(bnd), frames); err != nil {
+                return nil, err
+            }
+        }
+        delete(frames, e)
+        env = append(env, f)
+    }
+    return map[string]interface{}{"code": code, "env": env}, nil
+}
+
+func (vm *Vm) mapJSON(m value, frames map[value]bool) (interface{}, error) {
+    l := []interface{}{}
+    var err error
+    vm.mapWalk(vm.mapRoot(m), func(e value) {
+        var k, v interface{}
+        if err == nil {
+            k, err = vm.toJSON(vm.car(e), frames)
+        }
+        if err == nil {
+            v, err = vm.toJSON(vm.cdr(e), frames)
+        }
+        l = append(l, []interface{}{k, v})
+    })
+    if err != nil {
+        return nil, err
+    }
+    return map[string]interface{}{"map": l}, nil
+}
+
+// value from JSON, a value too large for the arena gives an error
+func (vm *Vm) DecodeJSON(data []byte) (v value, err error) {
+    defer catchVmError(&err)
+    d := json.NewDecoder(bytes.NewReader(data))
+    d.UseNumber()
+    var x interface{}
+    if err := d.Decode(&x); err != nil {
+        return nill, err
+    }
+    return vm.fromJSON(x)
+}
+
+// read the ket from a JSON array, top first
+func (vm *Vm) ParseKetJSON(data []byte) (k value, err error) {
+    defer catchVmError(&err)
+    d := json.NewDecoder(bytes.NewReader(data))
+    d.UseNumber()
+    var l []interface{}
+    if err := d.Decode(&l); err != nil {
+        return nill, fmt.Errorf("ket: %v", err)
+    }
+    k = nill
+    for i := len(l)-1; i >= 0; i-- {
+        v, err := vm.fromJSON(l[i])
+        if err != nil {
+            return nill, fmt.Errorf("ket: %v", err)
+        }
+        k = vm.cons(v, k)
+    }
+    return k, nil
+}
+
+// strings without a quote in front are read as a token of the source
+func (vm *Vm) fromJSON(x interface{}) (value, error) {
+    switch x := x.(type) {
+    case json.Number:
+        if v, _ := vm.parse([]byte(x)); isNumber(v) {
+            return v, nil
+        }
+        return nill, fmt.Errorf("%s is not a number", x)
+    case string:
+        if strings.HasPrefix(x, "'") {
+            return string2symbol(x[1:]), nil
+        }
+        t := tokenize([]byte(x))
+        if len(t) != 1 || strings.Contains("[]{}", string(t[0])) {
+            return nill, fmt.Errorf("%q is not a single token", x)
+        }
+        return vm.parse(t[0])
+    case []interface{}:
+        return vm.listFromJSON(x, nill)
+    case map[string]interface{}:
+        if l, ok := x["list"].([]interface{}); ok && len(x) == 2 {
+            tail, err := vm.fromJSON(x["tail"])
+            if err != nil {
+                return nill, err
+            }
+            return vm.listFromJSON(l, tail)
+        }
+        if _, ok := x["code"]; ok && len(x) == 2 {
+            return vm.closureFromJSON(x)
+        }
+        if l, ok := x["map"].([]interface{}); ok && len(x) == 1 {
+            return vm.mapFromJSON(l)
+        }
+        if l, ok := x["vector"].([]interface{}); ok && len(x) == 1 {
+            xs := make([]value, len(l))
+            for i, e := range l {
+                v, err := vm.fromJSON(e)
+                if err != nil {
+                    return nill, err
+                }
+                xs[i] = v
+            }
+            return vm.newVec(xs), nil
+        }
+    }
+    return nill, fmt.Errorf("cannot read %v", x)
+}
+
+func (vm *Vm) listFromJSON(l []interface{}, tail value) (value, error) {
+    q := tail
+    for _, e := range l {
+        v, err := vm.fromJSON(e)
+        if err != nil {
+            return nill, err
+        }
+        q = vm.cons(v, q)
+    }
+    return q, nil
+}
+
+func (vm *Vm) mapFromJSON(l []interface{}) (value, error) {
+    m := vm.newMap(0, nill)
+    for _, e := range l {
+        kv, ok := e.([]interface{})
+        if !ok || len(kv) != 2 {
+            return nill, errors.New("entry of map is not a pair [key, value]")
+        }
+        k, err := vm.fromJSON(kv[0])
+        if err != nil {
+            return nill, err
+        }
+        v, err := vm.fromJSON(kv[1])
+        if err != nil {
+            return nill, err
+        }
+        m = vm.mapAssoc(m, k, v)
+    }
+    return m, nil
+}
+
+// the captured frames are put in front of the global frame of the vm
+func (vm *Vm) closureFromJSON(x map[string]interface{}) (value, error) {
+    code, err := vm.fromJSON(x["code"])
+    if err != nil {
+        return nill, err
+    }
+    if !isCons(code) {
+        return nill, errors.New("code of closure is not a quotation")
+    }
+    frames, ok := x["env"].([]interface{})
+    if !ok {
+        return nill, errors.New("env of closure is not an array")
+    }
+    env := vm.env
+    for isDef(vm.cdr(env)) {
+        env = vm.cdr(env)
+    }
+    for i := len(frames)-1; i >= 0; i-- {
+        f, ok := frames[i].(map[string]interface{})
+        if !ok {
+            return nill, errors.New("frame of closure is not an object")
+        }
+        bnds := nill
+        for k, e := range f {
+            v, err := vm.fromJSON(e)
+            if err != nil {
+                return nill, err
+            }
+            bnds = vm.cons(vm.mcons(string2symbol(k), v), bnds)
+        }
+        env = vm.mcons(bnds, env)
+    }
+    return vm.closure(code, env), nil
+}
@@ -0,0 +1,295 @@
+// more math primitives
+// like + and gt they work on ints, big ints and floats, elementwise on lists and
+// vectors, and a symbol stands for its value, see fMath.
+// Unary operations are binary ones which ignore their second argument.
+package main
+
+import (
+    "errors"
+    "fmt"
+    "math"
+    "math/big"
+)
+
+// result of a division by zero, for / and mod
+type Division int
+
+const (
+    DivZero      Division = iota   // 0, the default
+    DivOne                         // 1, the protected division of Koza
+    DivNumerator                   // the dividend, x / 0 gives x
+    DivHalt                        // halt the evaluation with an error
+)
+
+var divisions = map[string]Division {
+    "zero": DivZero, "one": DivOne, "numerator": DivNumerator, "halt": DivHalt,
+}
+
+// choose the result of a division by zero by name, e.g. "one"
+func (vm *Vm) SetDivision(name string) error {
+    d, ok := divisions[name]
+    if !ok {
+        return fmt.Errorf("unknown division %s", name)
+    }
+    vm.division = d
+    return nil
+}
+
+func (vm *Vm) divByZero(x value) (value, bool) {
+    switch vm.division {
+    case DivOne:
+        return boxInt(1), true
+    case DivNumerator:
+        return x, true
+    case DivHalt:
+        vm.halt(errors.New("division by zero"))
+        return nill, false
+    }
+    return boxInt(0), true
+}
+
+// ints  ********************************
+
+func myMod(x,y int) (int, bool) {
+    if y==0 {
+        return 0, true
+    }
+    return x%y, true   // sign of x, as / truncates
+}
+
+func myMin(x,y int) (int, bool) {
+    if x<y {
+        return x, true
+    }
+    return y, true
+}
+
+func myMax(x,y int) (int, bool) {
+    if x>y {
+        return x, true
+    }
+    return y, true
+}
+
+func myGe(x,y int) (int, bool) {
+    if x>=y {
+        return 1, true
+    }
+    return 0, true
+}
+
+func myLe(x,y int) (int, bool) {
+    if x<=y {
+        return 1, true
+    }
+    return 0, true
+}
+
+// a negative power truncates like /, pow 0 -1 gives 0
+func myPow(x,y int) (int, bool) {
+    switch {
+    case x == 1 || y == 0:
+        return 1, true
+    case x == -1 && y%2 == 0:
+        return 1, true
+    case x == -1:
+        return -1, true
+    case y < 0 || x == 0:
+        return 0, true
+    }
+    r := 1
+    for ; y > 0; y-- {   // |x| >= 2, so at most 60 steps before an overflow
+        var ok bool
+        if r, ok = myMul(r, x); !ok {
+            return 0, false
+        }
+    }
+    return r, true
+}
+
+// shift x n shifts left for a positive n, right for a negative one
+func myShift(x,n int) (int, bool) {
+    switch {
+    case x == 0:
+        return 0, true
+    case n < 0:
+        return x >> uint(clip(-n, 0, 63)), true
+    case n < 60:
+        r := x << uint(n)
+        return r, r>>uint(n) == x && fits(r)
+    }
+    return 0, false
+}
+
+func myNeg(x,_ int) (int, bool) {return -x, fits(-x)}
+
+func myAbs(x,_ int) (int, bool) {
+    if x<0 {
+        return -x, fits(-x)
+    }
+    return x, true
+}
+
+// protected, the square root of -x is taken for a negative x
+func mySqrt(x,_ int) (int, bool) {
+    if x<0 {
+        x = -x
+    }
+    r := int(math.Sqrt(float64(x)))
+    for r*r > x {
+        r--
+    }
+    for (r+1)*(r+1) <= x {
+        r++
+    }
+    return r, true
+}
+
+func myAnd(x,y int) (int, bool) {return x & y, true}
+func myOr(x,y int)  (int, bool) {return x | y, true}
+func myXor(x,y int) (int, bool) {return x ^ y, true}
+
+// big ints  ****************************
+
+func bigMod(x, y *big.Int) *big.Int {
+    if y.Sign() == 0 {
+        return new(big.Int)
+    }
+    return x.Rem(x, y)
+}
+
+func bigMin(x, y *big.Int) *big.Int {
+    if x.Cmp(y) < 0 {
+        return x
+    }
+    return y
+}
+
+func bigMax(x, y *big.Int) *big.Int {
+    if x.Cmp(y) > 0 {
+        return x
+    }
+    return y
+}
+
+func bigPow(x, y *big.Int) *big.Int {
+    switch {
+    case y.Sign() >= 0:
+        return x.Exp(x, y, nil)
+    case x.CmpAbs(big.NewInt(1)) != 0:
+        return new(big.Int)   // truncated like /
+    case y.Bit(0) == 0:
+        return x.SetInt64(1)
+    }
+    return x   // 1 or -1
+}
+
+func bigShift(x, n *big.Int) *big.Int {
+    if n.Sign() >= 0 {
+        return x.Lsh(x, uint(n.Int64()))   // n is small, see shiftWords
+    }
+    if !n.IsInt64() || n.Int64() < -1<<30 {   // beyond any big int
+        return x.Rsh(x, 1<<30)
+    }
+    return x.Rsh(x, uint(-n.Int64()))
+}
+
+// words of the result of pow and shift, to check the size before
+// the result is computed
+func (vm *Vm) words(x value) int {
+    if isBig(x) {
+        return vm.vecLen(x)
+    }
+    return 2
+}
+
+func powWords(vm *Vm, x, y value) int {
+    b := vm.bigOf(x).BitLen()
+    switch {
+    case b <= 1 || vm.bigOf(y).Sign() <= 0:
+        return 2
+    case !isInt(y) || unbox(y) > len(vm.arena)*2*wordBits:
+        return maxInt   // too large for any arena
+    }
+    return b*unbox(y)/wordBits + 2
+}
+
+func shiftWords(vm *Vm, x, n value) int {
+    switch {
+    case vm.bigOf(n).Sign() <= 0:
+        return vm.words(x)
+    case !isInt(n) || unbox(n) > len(vm.arena)*2*wordBits:
+        return maxInt
+    }
+    return vm.words(x) + unbox(n)/wordBits + 1
+}
+
+func bigCmp(f func(int) bool) func(x, y *big.Int) *big.Int {
+    return func(x, y *big.Int) *big.Int {return bigBool(f(x.Cmp(y)))}
+}
+
+var opMod   = mathOp{int: myMod, big: bigMod, div: true, float: math.Mod}
+var opMin   = mathOp{int: myMin, big: bigMin, float: math.Min}
+var opMax   = mathOp{int: myMax, big: bigMax, float: math.Max}
+var opGe    = mathOp{int: myGe, big: bigCmp(func(c int) bool {return c >= 0}),
+                     test: func(x, y float64) bool {return x >= y}}
+var opLe    = mathOp{int: myLe, big: bigCmp(func(c int) bool {return c <= 0}),
+                     test: func(x, y float64) bool {return x <= y}}
+var opPow   = mathOp{int: myPow, big: bigPow, words: powWords, float: math.Pow, safe: safePow}
+var opShift = mathOp{int: myShift, big: bigShift, words: shiftWords}
+var opNeg   = mathOp{int: myNeg, big: func(x, _ *big.Int) *big.Int {return x.Neg(x)},
+                     float: func(x, _ float64) float64 {return -x}}
+var opAbs   = mathOp{int: myAbs, big: func(x, _ *big.Int) *big.Int {return x.Abs(x)},
+                     float: func(x, _ float64) float64 {return math.Abs(x)}}
+var opSqrt  = mathOp{int: mySqrt, big: func(x, _ *big.Int) *big.Int {return x.Sqrt(x.Abs(x))},
+                     float: func(x, _ float64) float64 {return math.Sqrt(x)},
+                     safe: func(x, _ float64) float64 {return math.Sqrt(math.Abs(x))}}
+var opBitAnd = mathOp{int: myAnd, big: func(x, y *big.Int) *big.Int {return x.And(x, y)}}
+var opBitOr  = mathOp{int: myOr, big: func(x, y *big.Int) *big.Int {return x.Or(x, y)}}
+var opBitXor = mathOp{int: myXor, big: func(x, y *big.Int) *big.Int {return x.Xor(x, y)}}
+
+// logical operations  ******************
+// as the words of the prelude did: and gives y if x is true and x otherwise,
+// or gives x if x is true and y otherwise
+
+func truth(b bool) value {
+    if b {
+        return boxInt(1)
+    }
+    return boxInt(0)
+}
+
+var opNot = mathOp{any: func(x, _ value) (value, bool) {return truth(!istrue(x)), true}}
+var opAnd = mathOp{any: func(x, y value) (value, bool) {
+    if istrue(x) {
+        return y, true
+    }
+    return x, true
+}}
+var opOr = mathOp{any: func(x, y value) (value, bool) {
+    if istrue(x) {
+        return x, true
+    }
+    return y, true
+}}
+
+// primitives  ********************************
+
+// unary math primitive, e.g. neg 5 or neg [1 2]
+func (vm *Vm) fMath1(op mathOp) {
+    var n value
+    if vm.pop(&vm.ket, &n) {
+        if isSymb(n) {
+            n = vm.boundvalue(n)
+        }
+        vm.math(op, n, boxInt(0))
+    }
+}
+
+// ne is not eq, it compares whole values like eq
+func (vm *Vm) fNe() {
+    var p1, p2 value
+    if vm.pop2(&vm.ket, &p1, &p2) {
+        vm.ket = vm.cons(truth(!vm.isEqual(p1, p2)), vm.ket)
+    }
+}
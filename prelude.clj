@@ -1,9 +1,6 @@
 ; Bracket prelude
 
 
-; still missing:
-; reverse, append (concat)
-
 def Y' [
   eval if [drop nip] [swapd X]
   swap dip [eq dupd rot1 keep2 eval']
@@ -22,17 +19,27 @@ def loop' [rec swap dip eval' over eval']
 
 ;def whl' [eval if eval rot [whl Rto eval Ris] [drop Rto] toR swap]
 
-def filter' [         ; reverse still missing
-  each cons swap [eval if rot cons' drop' swap keep] rot1 [] ]
+; the list primitives are words as well, for primitive sets without them
+def ?reverse' [reverse]
+def ?concat'  [concat]
+def ?size'    [size]
+def ?nth'     [nth]
+def ?take'    [take]
+def ?drop-n'  [drop-n]
+def ?last'    [last]
+
+; map, each, reduce and filter are primitives, and words for sets without them
+def ?map'    [map]
+def ?each'   [each]
+def ?reduce' [reduce]
+def ?filter' [filter]
 
-def size' [reduce [add 1 drop] 0]
 def sum'  [reduce [add] 0]
 def prod' [reduce [mul] 1]
 
-; we still need to reverse !!!
-def append' [reduce [cons] swap]   ; not yet working
+def append' [concat]
 
-;def spread' [eval if rot    ; concat not yet defined
+;def spread' [eval if rot
 ;   [cons concat rot [dip]]
 ;   [drop]
 ;   dup swap ]
@@ -40,25 +47,8 @@ def append' [reduce [cons] swap]   ; not yet working
 def cleave2' [drop drop each [keep2]]  ; eval a list of arguments on two arguments from ket
 def cleave' [drop each [keep]]  ; eval a list of arguments on a single argument from ket
 
-def reduce' [each swapd]
 def unstack' [each []]
 
-;def map1' [each rot1 [] append swap [cons]   ; for this we would need "append" first
-
-def map' [     ; needs a reverse still
-  drop drop eval if rot [
-     rec dup swap dip2 [cons eval] over rot1 splt
-  ]
-  [drop drop drop] dup rot rot [] swap
-]
-
-def each' [
-  drop drop eval if rot [
-     rec dup swap dip2 eval' over rot1 splt
-  ]
-  [drop drop] dup swap
-]
-
 ;def each' \[foo]
 ;  [drop eval [rec dup Rto foo toR swap car]]
 
@@ -0,0 +1,199 @@
+// primitives implemented in Go outside of the interpreter core
+// e.g. sensors and actuators of a simulator, exposed to evolved programs
+package main
+
+import (
+    "errors"
+    "fmt"
+)
+
+type userPrim struct {
+    name  string
+    arity int               // number of arguments taken from the ket
+    fn    func(*Vm) error
+}
+
+// codes of registered primitives follow the builtin primitives
+const firstUserPrim = unbound + 1<<4
+
+// register fn as primitive name with arity arguments
+// the primitive code is returned, name can then be used in code
+// fn takes its arguments from the ket and pushes its results
+// on the ket, an error returned by fn halts the evaluation
+func (vm *Vm) RegisterPrim(name string, arity int, fn func(*Vm) error) (value, error) {
+    if _, ok := str2prim[name]; ok {
+        return nill, fmt.Errorf("%s is a builtin primitive", name)
+    }
+    if _, ok := vm.userCodes[name]; ok {
+        return nill, fmt.Errorf("primitive %s already registered", name)
+    }
+    if arity < 0 {
+        return nill, errors.New("negative arity")
+    }
+    if vm.userPrims == nil {
+        vm.userPrims = make(map[value]userPrim)
+        vm.userCodes = make(map[string]value)
+    }
+    p := firstUserPrim + value(len(vm.userPrims))<<4
+    vm.userPrims[p] = userPrim{name, arity, fn}
+    vm.userCodes[name] = p
+    return p, nil
+}
+
+// as the builtin primitives, a registered primitive consumes
+// the arguments but does nothing if the ket is too short
+func (vm *Vm) evalUserPrim(up userPrim) {
+    var p value
+    k := vm.ket
+    for i:=0; i<up.arity; i++ {
+        if !vm.pop(&k, &p) {
+            vm.ket = k
+            return
+        }
+    }
+    if err := up.fn(vm); err != nil {
+        vm.halt(fmt.Errorf("%s: %w", up.name, err))
+    }
+}
+
+// stop the evaluation, only the first error is kept
+func (vm *Vm) halt(err error) {
+    if vm.err == nil {
+        vm.err = err
+    }
+}
+
+// fatal error of the vm (e.g. exhausted arena), raised as a panic
+// deep inside a primitive and turned into a halt by evalBra
+type vmError string
+
+func (e vmError) Error() string {return string(e)}
+
+// outside of evalBra a vmError is returned as the error of the function,
+// which must defer catchVmError(&err)
+func catchVmError(err *error) {
+    if r := recover(); r != nil {
+        e, ok := r.(vmError)
+        if !ok {
+            panic(r)
+        }
+        *err = e
+    }
+}
+
+func (vm *Vm) primName(p value) string {
+    p = plainPrim(p)
+    if up, ok := vm.userPrims[p]; ok {
+        return up.name
+    }
+    return primStr[p]
+}
+
+// primitive sets  ************************
+// a GP problem can restrict the primitives that evolved code may use
+// primitives not in the active set are read as ordinary symbols,
+// and if nevertheless executed (e.g. from data made before the set
+// was switched) they are no-ops, or halt the vm in strict mode
+
+// primitives read from the prelude carry libPrim, they run whatever the
+// set, so that the words of the prelude work under every set
+const libPrim value = 1 << 40
+
+func plainPrim(p value) value {return p &^ libPrim}
+
+// the primitive as it is printed and read back, argdef is shown as def
+func shownPrim(p value) value {
+    if p = plainPrim(p); p == argdef {
+        return def
+    }
+    return p
+}
+
+type PrimSet struct {
+    Name    string
+    Strict  bool      // executing a disabled primitive is an error
+    enabled []bool    // indexed by primitive number
+}
+
+// predefined sets, "full" (all primitives) is the default
+var primSets = map[string][]string {
+    "pure": {"dup", "drop", "swap", "rot", "cons", "car", "cdr", "eval",
+             "dip", "rec", "lambda", "+", "-", "*", "/", ">", "<", "rnd",
+             "eq", "if", "esc", "vesc", "val", "typ"},
+    "arith": {"dup", "drop", "swap", "rot", "+", "-", "*", "/", ">", "<",
+             "eq", "if", "eval", "esc"},
+    "stack": {"dup", "drop", "swap", "rot", "cons", "car", "cdr", "eval",
+             "dip", "esc"},
+    "math": {"dup", "drop", "swap", "rot", "+", "-", "*", "/", ">", "<",
+             "eq", "if", "eval", "esc", "mod", "neg", "abs", "minimum", "maximum",
+             "pow", "sqrt", "ge", "le", "ne", "bool-not", "bool-and", "bool-or"},
+    "float": {"dup", "drop", "swap", "rot", "+", "-", "*", "/", "sin", "cos",
+             "exp-e", "log-e"},
+    "logic": {"dup", "drop", "swap", "rot", "bool-and", "bool-or", "bool-not", "if", "eval"},
+}
+
+func (ps *PrimSet) has(p value) bool {
+    i := unbox(p)
+    return i < len(ps.enabled) && ps.enabled[i]
+}
+
+// make a set of the primitives with the given names
+// names of registered primitives are allowed as well
+func (vm *Vm) NewPrimSet(name string, names ...string) (*PrimSet, error) {
+    ps := &PrimSet{Name: name}
+    for _, n := range names {
+        p, ok := str2prim[n]
+        if !ok {
+            if p, ok = vm.userCodes[n]; !ok {
+                return nil, fmt.Errorf("unknown primitive %s", n)
+            }
+        }
+        ps.enable(p)
+    }
+    if ps.has(lambda) {   // closures bind their arguments with argdef
+        ps.enable(argdef)
+    }
+    return ps, nil
+}
+
+func (ps *PrimSet) enable(p value) {
+    for unbox(p) >= len(ps.enabled) {
+        ps.enabled = append(ps.enabled, false)
+    }
+    ps.enabled[unbox(p)] = true
+}
+
+// restrict the vm to a primitive set, nil enables all primitives
+func (vm *Vm) SetPrimSet(ps *PrimSet) {
+    vm.primSet = ps
+}
+
+// restrict the vm to one of the predefined sets
+func (vm *Vm) UsePrimSet(name string) error {
+    if name == "full" {
+        vm.primSet = nil
+        return nil
+    }
+    names, ok := primSets[name]
+    if !ok {
+        return fmt.Errorf("unknown primitive set %s", name)
+    }
+    ps, err := vm.NewPrimSet(name, names...)
+    vm.primSet = ps
+    return err
+}
+
+// all primitives enabled in the vm, ordered by their code
+// program generators and mutations should draw only from these
+func (vm *Vm) ActivePrims() []value {
+    var l []value
+    for p := dup; p < firstUserPrim + value(len(vm.userPrims))<<4; p += 1<<4 {
+        if p == unbound || p == argdef || (primStr[p] == "" && vm.userPrims[p].name == "") {
+            continue
+        }
+        if vm.primSet == nil || vm.primSet.has(p) {
+            l = append(l, p)
+        }
+    }
+    return l
+}
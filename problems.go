@@ -0,0 +1,307 @@
+// standard GP benchmark problems
+// symbolic regression (Koza's quartic and the Nguyen functions), boolean
+// problems (even parity and multiplexer) and the artificial ant on the
+// Santa Fe trail, so that bracket can be compared with other GP systems.
+// The inputs of a case are bound to variables, x and y, b0 b1 .. or
+// a0 a1 d0 d1 .., which the genomes use like the primitives.
+package main
+
+import (
+    "errors"
+    "fmt"
+    "math"
+)
+
+// a regression case within hitError of the target counts as a hit,
+// a program hitting all cases is a solution with error 0
+const hitError = 0.01
+
+// symbolic regression of f on n points drawn from [lo,hi) for each
+// variable, with a fixed seed so that runs can be compared
+// division by zero gives 1, as Koza's protected division
+func regression(name, doc string, vars []string, n int, lo, hi float64, f func(x []float64) float64) *Problem {
+    var r rng
+    r.seed(1)
+    ins := make([][]value, n)
+    outs := make([]float64, n)
+    for i := range ins {
+        x := make([]float64, len(vars))
+        for j := range x {
+            x[j] = unboxFloat(boxFloat(lo + float64(r.next()>>11) / (1<<53) * (hi-lo)))
+            ins[i] = append(ins[i], boxFloat(x[j]))
+        }
+        outs[i] = f(x)
+    }
+    return &Problem{Name: name, Doc: doc, PrimSet: "float", Vars: vars,
+        Setup: func(vm *Vm) error {return vm.SetDivision("one")},
+        Fitness: func(vm *Vm, prog value) float64 {
+            err, hits := 0.0, 0
+            mark := vm.protect(&prog)
+            defer vm.unprotect(mark)
+            for i, in := range ins {
+                if top, ok := vm.runInputs(prog, vars, in); !ok || !isNumber(top) {
+                    err += missPenalty
+                } else if d := math.Abs(vm.floatOf(top) - outs[i]); d < hitError {
+                    err += d
+                    hits++
+                } else {
+                    err += math.Min(d, missPenalty)
+                }
+            }
+            if hits == n {
+                return 0
+            }
+            return err
+        }}
+}
+
+// sum of the powers x^1 up to x^n
+func powers(n int) func(x []float64) float64 {
+    return func(x []float64) float64 {
+        s := 0.0
+        for i := 1; i <= n; i++ {
+            s += math.Pow(x[0], float64(i))
+        }
+        return s
+    }
+}
+
+// boolean problem of f on all combinations of the inputs, 0 and 1,
+// the error is the number of cases where the truth of the top is wrong
+func boolProblem(name, doc string, vars []string, f func(b []bool) bool) *Problem {
+    var ins [][]value
+    var outs []bool
+    for i := 0; i < 1<<len(vars); i++ {
+        b := make([]bool, len(vars))
+        in := make([]value, len(vars))
+        for j := range b {
+            b[j] = i>>j & 1 == 1
+            in[j] = truth(b[j])
+        }
+        ins = append(ins, in)
+        outs = append(outs, f(b))
+    }
+    return &Problem{Name: name, Doc: doc, PrimSet: "logic", Vars: vars,
+        Fitness: func(vm *Vm, prog value) float64 {
+            err := 0.0
+            mark := vm.protect(&prog)
+            defer vm.unprotect(mark)
+            for i, in := range ins {
+                if top, ok := vm.runInputs(prog, vars, in); !ok || istrue(top) != outs[i] {
+                    err++
+                }
+            }
+            return err
+        }}
+}
+
+func names(prefix string, n int) []string {
+    s := make([]string, n)
+    for i := range s {
+        s[i] = fmt.Sprintf("%s%d", prefix, i)
+    }
+    return s
+}
+
+// even-n-parity, true for an even number of true inputs b0 b1 ..
+func parity(n int) *Problem {
+    return boolProblem(fmt.Sprintf("parity%d", n), fmt.Sprintf("even-%d-parity of b0..b%d", n, n-1),
+        names("b", n), func(b []bool) bool {
+            even := true
+            for _, x := range b {
+                even = even != x
+            }
+            return even
+        })
+}
+
+// multiplexer with k address bits a0 a1 .. (a0 lowest) selecting one of the
+// data bits d0 d1 ..
+func multiplexer(k int) *Problem {
+    n := 1<<k
+    return boolProblem(fmt.Sprintf("mux%d", k+n), fmt.Sprintf("%d-multiplexer, a0..a%d select one of d0..d%d", k+n, k-1, n-1),
+        append(names("a", k), names("d", n)...), func(b []bool) bool {
+            i := 0
+            for j := k-1; j >= 0; j-- {
+                i = 2*i
+                if b[j] {
+                    i++
+                }
+            }
+            return b[k+i]
+        })
+}
+
+// artificial ant  ****************************
+// the ant starts at the upper left corner facing east and has antTime
+// moves and turns to eat the food of the trail, the program is run again
+// and again until the time is up. The grid wraps around.
+
+var santaFe = []string{
+    ".###............................",
+    "...#............................",
+    "...#.....................###....",
+    "...#....................#....#..",
+    "...#....................#....#..",
+    "...####.#####........##.........",
+    "............#................#..",
+    "............#.......#...........",
+    "............#.......#...........",
+    "............#.......#........#..",
+    "....................#...........",
+    "............#................#..",
+    "............#...................",
+    "............#.......#.....###...",
+    "............#.......#..#........",
+    ".................#..............",
+    "................................",
+    "............#...........#.......",
+    "............#...#..........#....",
+    "............#...#...............",
+    "............#...#...............",
+    "............#...#.........#.....",
+    "............#..........#........",
+    "............#...................",
+    "...##..#####....#...............",
+    ".#..............#...............",
+    ".#..............#...............",
+    ".#......#######.................",
+    ".#.....#........................",
+    ".......#........................",
+    "..####..........................",
+    "................................",
+}
+
+const antTime = 600
+
+var errAntTime = errors.New("out of time")
+
+type ant struct {
+    trail       []string
+    food        [][]bool
+    x, y, dx, dy int
+    time, eaten int
+    total       int
+}
+
+func (a *ant) reset() {
+    a.food = make([][]bool, len(a.trail))
+    a.total = 0
+    for y, row := range a.trail {
+        a.food[y] = make([]bool, len(row))
+        for x := range row {
+            a.food[y][x] = row[x] == '#'
+            if a.food[y][x] {
+                a.total++
+            }
+        }
+    }
+    a.x, a.y, a.dx, a.dy = 0, 0, 1, 0
+    a.time, a.eaten = 0, 0
+}
+
+// cell ahead of the ant
+func (a *ant) ahead() (int, int) {
+    h, w := len(a.food), len(a.food[0])
+    return (a.x + a.dx + w) % w, (a.y + a.dy + h) % h
+}
+
+func (a *ant) move() {
+    a.x, a.y = a.ahead()
+    if a.food[a.y][a.x] {
+        a.food[a.y][a.x] = false
+        a.eaten++
+    }
+}
+
+func (a *ant) left()  {a.dx, a.dy = a.dy, -a.dx}
+func (a *ant) right() {a.dx, a.dy = -a.dy, a.dx}
+
+// primitive of an action, which takes one time step
+func antAct(f func(a *ant)) func(vm *Vm) error {
+    return func(vm *Vm) error {
+        a := vm.problem.(*ant)
+        if a.time >= antTime {
+            return errAntTime
+        }
+        a.time++
+        f(a)
+        return nil
+    }
+}
+
+// food left on the trail, the program is run until the time is up, all
+// food is eaten or a run does not act
+func antFitness(vm *Vm, prog value) float64 {
+    a := vm.problem.(*ant)
+    mark := vm.protect(&prog)
+    defer vm.unprotect(mark)
+    a.reset()
+    for a.time < antTime && a.eaten < a.total {
+        t := a.time
+        vm.runInputs(prog, nil, nil)
+        if a.time == t {
+            break
+        }
+    }
+    return float64(a.total - a.eaten)
+}
+
+// the ant problem with the primitives move, left, right and food, which
+// pushes 1 if there is food ahead, e.g. eval if food [move] [left]
+// each vm has an ant of its own, so vms can evolve ants side by side
+func antProblem(name, doc string, trail []string) *Problem {
+    return &Problem{Name: name, Doc: doc, PrimSet: "logic", Fitness: antFitness,
+        Setup: func(vm *Vm) error {
+            prims := []struct {
+                name string
+                fn   func(vm *Vm) error
+            }{
+                {"move", antAct((*ant).move)}, {"left", antAct((*ant).left)}, {"right", antAct((*ant).right)},
+                {"food", func(vm *Vm) error {
+                    a := vm.problem.(*ant)
+                    x, y := a.ahead()
+                    vm.ket = vm.cons(truth(a.food[y][x]), vm.ket)
+                    return nil
+                }},
+            }
+            a := &ant{trail: trail}
+            a.reset()
+            vm.problem = a
+            for _, p := range prims {
+                if _, err := vm.RegisterPrim(p.name, 0, p.fn); err != nil {
+                    return err
+                }
+            }
+            return nil
+        }}
+}
+
+func init() {
+    x := []string{"x"}
+    xy := []string{"x", "y"}
+    for _, p := range []*Problem{
+        regression("quartic", "Koza's quartic x^4 + x^3 + x^2 + x, 20 points in [-1,1]", x, 20, -1, 1, powers(4)),
+        regression("nguyen1", "x^3 + x^2 + x, 20 points in [-1,1]", x, 20, -1, 1, powers(3)),
+        regression("nguyen2", "x^4 + x^3 + x^2 + x, 20 points in [-1,1]", x, 20, -1, 1, powers(4)),
+        regression("nguyen3", "x^5 + .. + x, 20 points in [-1,1]", x, 20, -1, 1, powers(5)),
+        regression("nguyen4", "x^6 + .. + x, 20 points in [-1,1]", x, 20, -1, 1, powers(6)),
+        regression("nguyen5", "sin(x^2) cos(x) - 1, 20 points in [-1,1]", x, 20, -1, 1,
+            func(x []float64) float64 {return math.Sin(x[0]*x[0]) * math.Cos(x[0]) - 1}),
+        regression("nguyen6", "sin(x) + sin(x + x^2), 20 points in [-1,1]", x, 20, -1, 1,
+            func(x []float64) float64 {return math.Sin(x[0]) + math.Sin(x[0] + x[0]*x[0])}),
+        regression("nguyen7", "log(x+1) + log(x^2+1), 20 points in [0,2]", x, 20, 0, 2,
+            func(x []float64) float64 {return math.Log(x[0]+1) + math.Log(x[0]*x[0]+1)}),
+        regression("nguyen8", "sqrt(x), 20 points in [0,4]", x, 20, 0, 4,
+            func(x []float64) float64 {return math.Sqrt(x[0])}),
+        regression("nguyen9", "sin(x) + sin(y^2), 100 points in [-1,1]^2", xy, 100, -1, 1,
+            func(x []float64) float64 {return math.Sin(x[0]) + math.Sin(x[1]*x[1])}),
+        regression("nguyen10", "2 sin(x) cos(y), 100 points in [-1,1]^2", xy, 100, -1, 1,
+            func(x []float64) float64 {return 2 * math.Sin(x[0]) * math.Cos(x[1])}),
+        parity(3), parity(4), parity(5),
+        multiplexer(2), multiplexer(3),
+        antProblem("ant", fmt.Sprintf("artificial ant on the Santa Fe trail, 89 pieces of food in %d steps", antTime), santaFe),
+    } {
+        RegisterProblem(p)
+    }
+}
@@ -0,0 +1,126 @@
+// test cases written in bracket
+// a test file holds blocks of the form
+//     expect [ket] code
+// the code (up to the next expect) is run in a fresh vm with the
+// prelude and must leave the ket given in the brackets, written
+// like the code, i.e. top of the ket first
+package main
+
+import (
+    "fmt"
+    "io"
+    "io/ioutil"
+    "path/filepath"
+    "strings"
+)
+
+type scriptCase struct {
+    file   string
+    line   int
+    expect string
+    code   string
+}
+
+func (c scriptCase) String() string {
+    return fmt.Sprintf("%s:%d: %s", c.file, c.line, c.code)
+}
+
+// read the test cases of a file
+func readScript(fname string) ([]scriptCase, error) {
+    b, err := ioutil.ReadFile(fname)
+    if err != nil {
+        return nil, err
+    }
+    var cases []scriptCase
+    var code []string
+    ns := newSrcReader(b).nodes(true)
+    for i := 0; i < len(ns); i++ {
+        n := ns[i]
+        switch {
+        case n.comment:
+        case !n.list && n.text == "expect":
+            if i+1 == len(ns) || !ns[i+1].list {
+                return nil, fmt.Errorf("%s:%d: expect without [ket]", fname, n.line)
+            }
+            if len(cases) > 0 {
+                cases[len(cases)-1].code = strings.Join(code, " ")
+            }
+            ket := ns[i+1].String()
+            cases = append(cases, scriptCase{file: fname, line: n.line,
+                expect: ket[1:len(ket)-1]})
+            code = nil
+            i++
+        case len(cases) == 0:
+            return nil, fmt.Errorf("%s:%d: code before the first expect", fname, n.line)
+        default:
+            code = append(code, n.String())
+        }
+    }
+    if len(cases) > 0 {
+        cases[len(cases)-1].code = strings.Join(code, " ")
+    }
+    return cases, nil
+}
+
+// run a test case on a fresh vm, returns a report of the failure or ""
+func (vm *Vm) runCase(c scriptCase) string {
+    vm.bra = vm.makeBra(c.code)
+    vm.evalBra()
+    // build expected ket only now, it is not protected from the gc
+    want, _ := vm.reverse(vm.makeBra(c.expect))
+    if vm.err == nil && vm.isEqual(vm.ket, want) {
+        return ""
+    }
+    i := 0   // first element that differs
+    for got := vm.ket; isCell(got) && isCell(want) && vm.isEqual(vm.car(got), vm.car(want)); i++ {
+        got, want = vm.cdr(got), vm.cdr(want)
+    }
+    report := fmt.Sprintf("%s\n    expected: %s\n    got:      %s", c,
+        c.expect, vm.ketString(vm.ket))
+    if vm.err != nil {
+        return report + "\n    error:    " + vm.err.Error()
+    }
+    return report + fmt.Sprintf("\n    first difference at element %d from the top", i)
+}
+
+// ket as in the tests, top first
+func (vm *Vm) ketString(k value) string {
+    k, _ = vm.reverse(k)
+    s := vm.PrettyPrint(k, 1<<30)
+    return s[1:len(s)-1]
+}
+
+// run all test cases of the files, directories are searched for .clj files
+// each case runs on a fresh vm made by newVm, so that nothing carries over
+// from one case to the next (primitives, division mode, rng ..)
+// failures are printed to out, the number of failed cases is returned
+func runScripts(fnames []string, newVm func() (*Vm, error), out io.Writer) (int, error) {
+    var files []string
+    for _, f := range fnames {
+        if m, _ := filepath.Glob(filepath.Join(f, "*.clj")); len(m) > 0 {
+            files = append(files, m...)
+        } else {
+            files = append(files, f)
+        }
+    }
+    n, failed := 0, 0
+    for _, f := range files {
+        cases, err := readScript(f)
+        if err != nil {
+            return failed, err
+        }
+        for _, c := range cases {
+            n++
+            vm, err := newVm()
+            if err != nil {
+                return failed, err
+            }
+            if report := vm.runCase(c); report != "" {
+                fmt.Fprintln(out, "FAIL", report)
+                failed++
+            }
+        }
+    }
+    fmt.Fprintf(out, "%d tests, %d failed\n", n, failed)
+    return failed, nil
+}
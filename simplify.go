@@ -0,0 +1,257 @@
+// simplification of evolved programs
+// removes introns (dead and neutral code such as "drop 1" or
+// "swap swap"), folds constants and removes unreferenced bindings,
+// without changing the ket a program leaves
+package main
+
+// a unit of code in the order of evaluation, escaped elements
+// (x' and x`) form a unit together with their escape
+type unit []value
+
+// simplify program q
+// nested quotations are simplified only where they surely are code:
+// when evaluated right away (eval [..], dip [..]), or bound by def to
+// a word that is only called, if the program never looks into
+// quotations as data
+// a program whose simplification does not fit into the arena, e.g.
+// a folded big int, is returned as it is
+func (vm *Vm) simplify(q value) (r value) {
+    if vm.needGc {   // no gc during simplification, units are not rooted
+        mark := vm.protect(&q)
+        vm.gc()
+        vm.unprotect(mark)
+    }
+    defer func() {
+        if e := recover(); e != nil {
+            if _, ok := e.(vmError); !ok {
+                panic(e)
+            }
+            r = q
+        }
+    }()
+    s := simplifier{vm: vm, refs: map[value]int{}, escaped: map[value]int{}}
+    s.count(q)
+    return s.quotation(q)
+}
+
+type simplifier struct {
+    vm       *Vm
+    refs     map[value]int   // occurrences of each symbol
+    escaped  map[value]int   // occurrences as x' or x`
+    inspects bool   // program may look into quotations as data
+}
+
+// primitives which can treat quotations as data
+var inspectPrims = map[value]bool {
+    car: true, cdr: true, cons: true, eq: true, rnd: true, val: true,
+    vesc: true, print: true, typ: true, lambda: true,
+    reverse: true, concat: true, size: true, nth: true, take: true,
+    dropn: true, last: true, mapp: true, each: true, reduce: true, filter: true,
+    assoc: true, get: true, dissoc: true, keys: true, has: true,
+    setnth: true, slice: true,
+}
+
+// count references of all symbols, and check how quotations are used
+func (s *simplifier) count(q value) {
+    var e, prev value
+    for isCons(q) {
+        s.vm.pop(&q, &e)
+        switch {
+        case isCons(e):
+            s.count(e)
+        case isPrim(e) && inspectPrims[e]:
+            s.inspects = true
+        case isSymb(e):
+            s.refs[e]++
+            if prev == esc || prev == vesc {
+                s.escaped[e]++
+            }
+            if isDef(s.vm.boundvalue(e)) {   // words of the prelude
+                s.refs[e]++
+                s.inspects = true
+            }
+        }
+        prev = e
+    }
+    if isDef(q) {  // dotted list
+        s.inspects = true
+    }
+}
+
+// split quotation into units
+func (s *simplifier) units(q value) []unit {
+    var us []unit
+    var e, x value
+    for s.vm.pop(&q, &e) {
+        if (e == esc || e == vesc) && s.vm.pop(&q, &x) {
+            us = append(us, unit{e, x})
+        } else {
+            us = append(us, unit{e})
+        }
+    }
+    return us
+}
+
+// unit pushes a value without any other effect
+func isPush(u unit) bool {
+    if len(u) == 2 {
+        return true
+    }
+    return isNumb(u[0]) || isBig(u[0]) || isCons(u[0]) || isNil(u[0])
+}
+
+// value of a literal unit
+func literal(u unit) (value, bool) {
+    if len(u) == 2 && u[0] == esc {
+        return u[1], true
+    }
+    if len(u) == 1 && isPush(u) {
+        return u[0], true
+    }
+    return nill, false
+}
+
+var foldOps = map[value]mathOp {
+    add: opAdd, sub: opSub, mul: opMul, div: opDiv, gt: opGt, lt: opLt,
+    mod: opMod, minimum: opMin, maximum: opMax, ge: opGe, le: opLe,
+    bitand: opBitAnd, bitor: opBitOr, bitxor: opBitXor,
+}
+
+var commutative = map[value]bool {add: true, mul: true, eq: true}
+
+// primitives disabled by the primitive set do nothing, or halt
+func (s *simplifier) enabled(p value) bool {
+    return s.vm.primSet == nil || s.vm.primSet.has(p)
+}
+
+// unit u is the enabled primitive p
+func (s *simplifier) is(u unit, p value) bool {
+    return u[0] == p && s.enabled(p)
+}
+
+// a symbol bound by def which is only called
+func (s *simplifier) isWord(u unit) bool {
+    return len(u) == 2 && u[0] == esc && isSymb(u[1]) && s.escaped[u[1]] == 1
+}
+
+func (s *simplifier) quotation(q value) value {
+    if !isCons(q) || isDef(s.tail(q)) {   // leave dotted lists alone
+        return q
+    }
+    us := s.units(q)
+    for changed := true; changed; {
+        us, changed = s.pass(us)
+    }
+    // simplify quotations that are code
+    for i, u := range us {
+        if len(u) != 1 || !isCons(u[0]) {
+            continue
+        }
+        if i+1 < len(us) && (us[i+1][0] == eval || us[i+1][0] == dip) ||
+            !s.inspects && i+2 < len(us) && s.isWord(us[i+1]) && us[i+2][0] == def {
+            us[i] = unit{s.quotation(u[0])}
+        }
+    }
+    l := nill
+    for i := len(us)-1; i >= 0; i-- {
+        for j := len(us[i])-1; j >= 0; j-- {
+            l = s.vm.cons(us[i][j], l)
+        }
+    }
+    return l
+}
+
+func (s *simplifier) tail(q value) value {
+    for isCons(q) {
+        q = s.vm.cdr(q)
+    }
+    return q
+}
+
+// one pass of peephole rewrites, g is the ket depth that is
+// guaranteed by the code before (the initial ket is unknown)
+func (s *simplifier) pass(us []unit) ([]unit, bool) {
+    var out []unit
+    changed := false
+    g := 0
+    for _, u := range us {
+        out = append(out, u)
+        n := len(out)
+        rewritten := true
+        switch {
+        case isPrim(u[0]) && !s.enabled(u[0]):
+            rewritten = false
+        // def of an unreferenced symbol just drops the value
+        case u[0] == def && n >= 2 && s.isWord(out[n-2]) && s.refs[out[n-2][1]] == 1:
+            out = append(out[:n-2], unit{drop})
+        // push and drop, dup and drop
+        case u[0] == drop && n >= 2 && (isPush(out[n-2]) || s.is(out[n-2], dup)):
+            out = out[:n-2]
+        // neutral permutations, if the elements are on the ket for sure
+        case u[0] == swap && n >= 2 && s.is(out[n-2], swap) && g >= 2:
+            out = out[:n-2]
+        case u[0] == rot && n >= 3 && s.is(out[n-2], rot) && s.is(out[n-3], rot) && g >= 3:
+            out = out[:n-3]
+        case commutative[u[0]] && n >= 2 && s.is(out[n-2], swap) && g >= 2:
+            out = append(out[:n-2], u)
+        case n >= 3 && (foldOps[u[0]].int != nil || u[0] == eq):
+            a, ok1 := literal(out[n-2])
+            b, ok2 := literal(out[n-3])
+            switch {
+            case ok1 && ok2 && u[0] == eq:
+                r := boxInt(0)
+                if s.vm.isEqual(a, b) {
+                    r = boxInt(1)
+                }
+                out = append(out[:n-3], unit{r})
+            // a division by zero that halts is kept, as is what pushes nothing
+            case ok1 && ok2 && isNumber(a) && isNumber(b) && !(foldOps[u[0]].div && s.vm.floatOf(b) == 0 && s.vm.division == DivHalt):
+                if r, ok := s.vm.arith(foldOps[u[0]], a, b); ok {
+                    out = append(out[:n-3], unit{r})
+                } else {
+                    rewritten = false
+                }
+            default:
+                rewritten = false
+            }
+        case u[0] == iff && n >= 4:
+            c, ok1 := literal(out[n-2])
+            _, ok2 := literal(out[n-3])
+            _, ok3 := literal(out[n-4])
+            if !ok1 || !ok2 || !ok3 {
+                rewritten = false
+                break
+            }
+            chosen := out[n-4]
+            if istrue(c) {
+                chosen = out[n-3]
+            }
+            out = append(out[:n-4], chosen)
+        default:
+            rewritten = false
+        }
+        if rewritten {   // recompute the depth from scratch
+            changed = true
+            g = 0
+            for _, v := range out {
+                g = s.depth(v, g)
+            }
+        } else {
+            g = s.depth(u, g)
+        }
+    }
+    return out, changed
+}
+
+// guaranteed ket depth after unit u
+func (s *simplifier) depth(u unit, g int) int {
+    if isPush(u) {
+        return g + 1
+    }
+    if pe, ok := primEffect[u[0]]; ok && s.enabled(u[0]) {
+        if g >= pe[0] {
+            return g - pe[0] + pe[1]
+        }
+    }
+    return 0
+}
@@ -0,0 +1,201 @@
+// snapshot and restore of a bracket vm
+package main
+
+import (
+    "encoding/gob"
+    "errors"
+    "os"
+)
+
+// on-disk image of a vm
+// gob needs exported fields, so cells are flattened into car/cdr pairs
+type snapshot struct {
+    Next   int
+    Arena  []value   // live part of arena as car, cdr, car, cdr, ..
+    Vecs   []value   // live part of the vector region
+    Bra    value
+    Ket    value
+    Env    value
+    Stack  []value
+    Depth  int
+    Trace  int
+    NInst  int
+    NRecur int
+    NSteps int
+    Extent int
+    Rng    uint64
+    HashCons bool    // settings, restored with the state
+    Nursery  int     // 0 without generational gc
+    Prims    map[string]value  // registered primitives, the vm must have the same
+    PrimSet  *savedPrimSet     // nil allows all primitives
+    MaxSteps int
+    Division Division
+    IEEE     bool
+}
+
+type savedPrimSet struct {
+    Name    string
+    Strict  bool
+    Enabled []bool
+}
+
+// write the complete state of the vm to file fname
+// the arena is compacted by a gc first, so only live cells are saved
+func (vm *Vm) Snapshot(fname string) error {
+    vm.fullGc()
+    s := snapshot{
+        Next:  vm.next,
+        Arena: make([]value, 2*vm.next),
+        Vecs:  append([]value(nil), vm.vecs[:vm.vecNext]...),
+        Bra:   vm.bra,
+        Ket:   vm.ket,
+        Env:   vm.env,
+        Stack: append([]value(nil), vm.stack[:vm.stackIndex+1]...),
+        Depth: vm.depth,
+        Trace: vm.trace,
+        NInst:  vm.stats.nInst,
+        NRecur: vm.stats.nRecur,
+        NSteps: vm.stats.nSteps,
+        Extent: vm.stats.extent,
+        Rng:    vm.rng.state,
+        HashCons: vm.hashCons,
+        Nursery:  vm.nursery,
+        Prims:    vm.userCodes,
+        MaxSteps: vm.maxSteps,
+        Division: vm.division,
+        IEEE:     vm.ieee,
+    }
+    if ps := vm.primSet; ps != nil {
+        s.PrimSet = &savedPrimSet{ps.Name, ps.Strict, ps.enabled}
+    }
+    for i:=0; i<vm.next; i++ {
+        s.Arena[2*i]   = vm.arena[i].car
+        s.Arena[2*i+1] = vm.arena[i].cdr
+    }
+    f, err := os.Create(fname)
+    if err != nil {
+        return err
+    }
+    if err = gob.NewEncoder(f).Encode(&s); err != nil {
+        f.Close()
+        return err
+    }
+    return f.Close()
+}
+
+// replace the state of the vm by a snapshot read from file fname
+// on error the vm is left unchanged
+func (vm *Vm) Restore(fname string) error {
+    f, err := os.Open(fname)
+    if err != nil {
+        return err
+    }
+    defer f.Close()
+    var s snapshot
+    if err = gob.NewDecoder(f).Decode(&s); err != nil {
+        return err
+    }
+    if s.Next >= vm.gcMargin || len(s.Arena) != 2*s.Next || len(s.Vecs) > vm.vecLimit {
+        return errors.New("snapshot does not fit into arena")
+    }
+    if len(s.Stack) > stackSize {
+        return errors.New("snapshot does not fit into stack")
+    }
+    // Go functions are not saved, so the primitives must be registered again
+    if len(s.Prims) != len(vm.userCodes) {
+        return errors.New("snapshot made with other registered primitives")
+    }
+    for name, p := range s.Prims {
+        if q, ok := vm.userCodes[name]; !ok || q != p {
+            return errors.New("snapshot made with other registered primitives")
+        }
+    }
+    if err := vm.checkSnapshot(&s); err != nil {
+        return err
+    }
+    for i:=0; i<s.Next; i++ {
+        vm.arena[i] = cell{s.Arena[2*i], s.Arena[2*i+1]}
+    }
+    vm.next = s.Next
+    vm.vecNext = copy(vm.vecs, s.Vecs)
+    vm.vecOld = vm.vecNext
+    vm.bra = s.Bra
+    vm.ket = s.Ket
+    vm.env = s.Env
+    vm.stackIndex = copy(vm.stack, s.Stack) - 1
+    vm.depth = s.Depth
+    vm.trace = s.Trace
+    vm.stats = stats{s.NInst, s.NRecur, s.NSteps, s.Extent}
+    vm.rng.state = s.Rng
+    vm.oldTop = vm.next
+    vm.remembered = vm.remembered[:0]
+    vm.youngHashed = vm.youngHashed[:0]
+    vm.setHashCons(s.HashCons)
+    vm.generational, vm.nursery = s.Nursery > 0, s.Nursery
+    vm.maxSteps = s.MaxSteps
+    vm.division = s.Division
+    vm.ieee = s.IEEE
+    vm.primSet = nil
+    if ps := s.PrimSet; ps != nil {
+        vm.primSet = &PrimSet{Name: ps.Name, Strict: ps.Strict, enabled: ps.Enabled}
+    }
+    vm.setGcLimit()
+    vm.needGc = false
+    return nil
+}
+
+// a corrupt snapshot would make car, cdr or the gc panic later, so
+// all values must have a known tag and point into the saved cells
+// or to the start of a saved vector
+func (vm *Vm) checkSnapshot(s *snapshot) error {
+    vecs := map[int]bool{}
+    for i := 0; i < len(s.Vecs); i += unbox(s.Vecs[i]) + 1 {
+        if !isInt(s.Vecs[i]) || unbox(s.Vecs[i]) < 0 || i + unbox(s.Vecs[i]) >= len(s.Vecs) {
+            return errors.New("corrupt snapshot, bad vector")
+        }
+        vecs[i] = true
+    }
+    valid := func(x value) bool {
+        switch {
+        case isPrim(x):   // unbound marks the cells copied by the gc
+            x = plainPrim(x)
+            _, user := vm.userPrims[x]
+            return x >= nill && x < unbound || user
+        case !isPtr(x):
+            return true   // symbol, int or float
+        }
+        switch x & tagMask {
+        case 0, tagClosure, tagMap:   // cons, closure and map
+            return unbox(x) >= 0 && unbox(x) < s.Next
+        case tagVec:
+            return vecs[unbox(x)]
+        case tagBig:   // the whole block must be saved
+            i := unbox(x)
+            if i < 0 || i >= s.Next || !isInt(s.Arena[2*i]) {
+                return false
+            }
+            n := unbox(s.Arena[2*i])
+            return n >= 0 && n < 2*s.Next && i + blockCells(n) <= s.Next
+        }
+        return false
+    }
+    for _, x := range s.Arena {
+        if !valid(x) {
+            return errors.New("corrupt snapshot, bad value in arena")
+        }
+    }
+    for i, x := range s.Vecs {
+        if !vecs[i] && !valid(x) {
+            return errors.New("corrupt snapshot, bad value in a vector")
+        }
+    }
+    for _, x := range append([]value{s.Bra, s.Ket}, s.Stack...) {
+        if !valid(x) {
+            return errors.New("corrupt snapshot, bad value in a register or the stack")
+        }
+    }
+    if !isCons(s.Env) || !valid(s.Env) {
+        return errors.New("corrupt snapshot, bad environment")
+    }
+    return nil
+}
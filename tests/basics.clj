@@ -0,0 +1,74 @@
+; test cases in bracket: expect [ket] code
+; the ket is written like the code, top first
+
+; values and escapes
+expect [1 2 3] 1 2 3
+expect [x 4] x' 4
+expect [[1 2 3]] [1 2 3]'
+
+; stack shuffling
+expect [2 2 3] dup 2 3
+expect [3] drop 2 3
+expect [3 2] swap 2 3
+expect [3 1 2] rot 1 2 3
+expect [] rot 1
+
+; arithmetic
+expect [5] + 2 3
+expect [1] - 3 2
+expect [3] / 7 2
+expect [1 0] gt 3 2 gt 2 3
+expect [1 0] eq [1 2] [1 2] eq 1 2
+
+; lists
+expect [3] car [1 2 3]
+expect [[1 2]] cdr [1 2 3]
+expect [[1 2 0]] cons 0 [1 2]
+expect [[3 2 1]] reverse [1 2 3]
+expect [[1 2 3 4]] concat [1 2] [3 4]
+expect [3 2] size [1 2 3] nth 1 [1 2 3]
+expect [[2 3] [1] 1] take 2 [1 2 3] drop-n 2 [1 2 3] last [1 2 3]
+
+; maps
+expect [{a 1 b 2}] assoc b' 2 {a 1}
+expect [2 []] get b' {a 1 b 2} get c' {a 1}
+expect [1 0] has a' {a 1} has b' {a 1}
+expect [{b 2} {a 1}] dissoc a' {a 1 b 2} dissoc c' {a 1}
+expect [{a 1} {a 1 b 2}] m assoc b' 2 m def m' {a 1}
+expect [3 1] get [1 2] {[1 2] 3} eq {a 1 b 2} {b 2 a 1}
+expect [2 [a] 6] size {a 1 b 2} keys {a 1} typ {}
+
+; vectors
+expect [a #[a x c]] nth 0 #[a b c] set-nth 1 x' #[a b c]
+expect [#[b c] 3 7] slice 1 3 #[a b c d] len #[a b c] typ #[]
+expect [#[11 12] #[4 10]] + #[1 2] 10 * #[1 2 3] #[4 5]
+expect [#[2 4] #[9 18] #[]] + #[1 2] [1 2] - [10 20 30] #[1 2] + #[1 2] []
+expect [1 0] eq #[1 [2]] #[1 [2]] eq #[1 2] #[2 1]
+
+; big ints
+expect [1000000000000000000000000 1] * 1000000000000 1000000000000 eq 100000000000000000000 * 10 10000000000000000000
+expect [-576460752303423487 576460752303423487] - 1 576460752303423488 - 576460752303423488 1
+expect [0 1 1] gt 5 100000000000000000000 lt 5 100000000000000000000 typ 100000000000000000000
+expect [#[2 1152921504606846974] [-100000000000000000000]] * 2 #[1 576460752303423487] * -10 [10000000000000000000]
+
+; more math
+expect [1 -1 4 2] mod 7 3 mod -7 3 sqrt 17 abs -2
+expect [1 3 [-1 2] 1024] minimum 1 3 maximum 1 3 neg [1 -2] pow 2 10
+expect [1 0 1 0] ge 3 3 le 4 3 ne 1 2 ne [1 2] [1 2]
+expect [8 14 6 1024 -3] bit-and 12 10 bit-or 12 10 bit-xor 12 10 shift 1 10 shift -5 -1
+expect [1 5 [] 2 [0 1 1]] bool-not 0 bool-and 2 5 bool-and [] 1 bool-or 2 5 bool-not [1 0 0]
+expect [1267650600228229401496703205376 #[1 4 9]] pow 2 100 pow #[1 2 3] 2
+
+; floats, protected unless run with -ieee
+expect [2.5 0.5 0.25 8] + 1.5 1 * 2 0.25 / 1.0 4 typ 1.5
+expect [0.0 1.0 1.0 0.0 0.0 1.0] sin 0.0 cos 0.0 exp-e 0.0 log-e 1.0 log-e 0 log-e -2.718281828459045
+expect [0.0 2.0 1.797693134862313e+308] / 1.0 0 sqrt -4.0 exp-e 1000.0
+expect [2 -2 3.0 1 0] to-int 2.7 to-int -2.7 to-float 3 gt 1.5 1 eq 1 1.0
+expect [[0.0 1.0] #[0.5 2.0] 1e-05 123456789.0] tanh [0 100.0] * #[1 4] 0.5 1e-5 123456789.0
+expect [[4.0 0.0 0.9375]] map \[x] [+ x * x + x * x + x * x x] [1.0 -1.0 0.5]
+
+; definitions and closures
+expect [16] sq 4 def sq' [* dup]
+expect [3] eval \[x y] [+ x y] 1 2
+expect [24] fac 4 def fac' [eval if rot [1 drop] [* fac - swap 1 dup] eq 1 dup]
+expect [15511210043330985984000000] fac 25 def fac' [eval if rot [1 drop] [* fac - swap 1 dup] eq 1 dup]
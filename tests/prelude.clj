@@ -0,0 +1,20 @@
+; words of the prelude
+
+expect [10] sum [1 2 3 4]
+expect [24] prod [1 2 3 4]
+expect [4] size [1 2 3 4]
+expect [2 1 2] over 1 2
+expect [1 3 2] swapd 1 2 3
+expect [2 3 1] rot1 1 2 3
+expect [1] nip 1 2
+expect [1 2 2] dupd 1 2
+expect [1 2] keep [+ 1] 1
+expect [0 1] not 1 not 0
+expect [1 0] and 1 1 and 1 0
+expect [1 0] or 0 1 or 0 0
+expect [1 1] isNil [] isDef 1
+
+; lists keep their order
+expect [[2 4 6]] map [* 2] [1 2 3]
+expect [[3 4]] filter [gt swap 2] [3 4 1]
+expect [[1 2 3]] append [1] [2 3]
@@ -0,0 +1,216 @@
+// vectors
+// a vector is a block in the vector region, a region of values next to
+// the arena with a bump pointer of its own: the number n of elements
+// followed by the elements. The gc copies the live blocks into a second
+// region, as it does with cells, so an element is found in constant
+// time. Vectors are never changed, set-nth copies the vector.
+// Big ints are blocks of cells in the arena, a header cell (n . sign)
+// followed by the words, two to a cell.
+// Elements count from 0 in the order of the source, #[a b c] has a at 0
+package main
+
+// cells of a block in the arena with n words
+func blockCells(n int) int {return 1 + (n+1)/2}
+
+// number of elements of a vector, or of words of a big int
+func (vm *Vm) vecLen(v value) int {
+    if isVec(v) {
+        return unbox(vm.vecs[unbox(v)])
+    }
+    return unbox(vm.car(v))
+}
+
+func (vm *Vm) vecAt(v value, i int) value {
+    if isVec(v) {
+        return vm.vecs[unbox(v)+1+i]
+    }
+    c := vm.arena[unbox(v)+1+i/2]
+    if i % 2 == 0 {
+        return c.car
+    }
+    return c.cdr
+}
+
+func (vm *Vm) vecElems(v value) []value {
+    xs := make([]value, vm.vecLen(v))
+    for i := range xs {
+        xs[i] = vm.vecAt(v, i)
+    }
+    return xs
+}
+
+// block of the values xs with header (n . kind), returns its index
+// the cells must follow each other, so the gc must not run, see reserve
+func (vm *Vm) newBlock(xs []value, kind value) int {
+    ind := vm.makeCons(boxInt(len(xs)), kind)
+    for i := 0; i < len(xs); i += 2 {
+        y := nill
+        if i+1 < len(xs) {
+            y = xs[i+1]
+        }
+        vm.makeCons(xs[i], y)
+    }
+    return ind
+}
+
+// vector of the values xs, the gc is needed when the vector region
+// passes its limit, and it must have run before it is full, see reserveVec
+func (vm *Vm) newVec(xs []value) value {
+    i := vm.vecNext
+    if i + len(xs) + 1 > len(vm.vecs) {
+        panic(vmError("vector region exhausted"))
+    }
+    vm.vecs[i] = boxInt(len(xs))
+    copy(vm.vecs[i+1:], xs)
+    vm.vecNext += len(xs) + 1
+    if vm.vecNext > vm.vecLimit {
+        vm.needGc = true
+    }
+    return boxVec(i)
+}
+
+// run the gc now if a vector of n elements would pass the limit of the
+// vector region, the values of the caller must be protected
+func (vm *Vm) reserveVec(n int) {
+    if vm.vecNext + n + 1 > vm.vecLimit {
+        vm.needGc = true
+        vm.maybeGc()
+    }
+}
+
+// vector of the elements of l in source order, l ends with the first
+func (vm *Vm) vecFromList(l value) value {
+    var xs []value
+    for ; isCons(l); l = vm.cdr(l) {
+        xs = append(xs, vm.car(l))
+    }
+    for i, j := 0, len(xs)-1; i < j; i, j = i+1, j-1 {
+        xs[i], xs[j] = xs[j], xs[i]
+    }
+    return vm.newVec(xs)
+}
+
+func (vm *Vm) vecEqual(v1, v2 value) bool {
+    n := vm.vecLen(v1)
+    if n != vm.vecLen(v2) {
+        return false
+    }
+    for i := 0; i < n; i++ {
+        if !vm.isEqual(vm.vecAt(v1, i), vm.vecAt(v2, i)) {
+            return false
+        }
+    }
+    return true
+}
+
+// primitives  ********************************
+// as for lists, a symbol stands for the vector bound to it
+
+func (vm *Vm) vecArg(p *value) bool {
+    if isSymb(*p) {
+        *p = vm.boundvalue(*p)
+    }
+    return isVec(*p)
+}
+
+func clip(i, lo, hi int) int {
+    if i < lo {
+        return lo
+    }
+    if i > hi {
+        return hi
+    }
+    return i
+}
+
+// set-nth 1 x #[a b c] gives #[a x c], nothing is pushed if the
+// index is out of range
+func (vm *Vm) fSetnth() {
+    var p, x, v value
+    if vm.pop2(&vm.ket, &p, &x) && vm.pop(&vm.ket, &v) && isInt(p) && vm.vecArg(&v) {
+        i := unbox(p)
+        if i < 0 || i >= vm.vecLen(v) {
+            return
+        }
+        mark := vm.protect(&x, &v)
+        vm.reserveVec(vm.vecLen(v))
+        vm.unprotect(mark)
+        xs := vm.vecElems(v)
+        xs[i] = x
+        vm.ket = vm.cons(vm.newVec(xs), vm.ket)
+    }
+}
+
+// slice i j v gives the elements from i up to j (without j)
+// indices are clipped to the vector
+func (vm *Vm) fSlice() {
+    var p1, p2, v value
+    if vm.pop2(&vm.ket, &p1, &p2) && vm.pop(&vm.ket, &v) && isInt(p1) && isInt(p2) && vm.vecArg(&v) {
+        n := vm.vecLen(v)
+        i := clip(unbox(p1), 0, n)
+        j := clip(unbox(p2), i, n)
+        mark := vm.protect(&v)
+        vm.reserveVec(j-i)
+        vm.unprotect(mark)
+        vm.ket = vm.cons(vm.newVec(vm.vecElems(v)[i:j]), vm.ket)
+    }
+}
+
+// a list meeting a vector in math is taken as the vector of its elements
+// in source order, + #[1 2] [10 20] gives #[11 22]
+// other is protected from the gc
+func (vm *Vm) listAsVec(l, other *value) {
+    vm.stripClosure(l)
+    if !isCons(*l) && *l != nill {
+        return
+    }
+    n := 0
+    for x := *l; isCons(x); x = vm.cdr(x) {
+        n++
+    }
+    mark := vm.protect(l, other)
+    vm.reserveVec(n)
+    vm.unprotect(mark)
+    *l = vm.vecFromList(*l)
+}
+
+// apply op elementwise like mathList, if one of n1, n2 is a vector
+// and the other a vector or a number
+func (vm *Vm) mathVec(op mathOp, n1, n2 value) (value, bool) {
+    elem := func(v value, i int) value {
+        x := v
+        if isVec(v) {
+            x = vm.vecAt(v, i)
+        }
+        if isSymb(x) {
+            x = vm.boundvalue(x)
+        }
+        return x
+    }
+    var n int
+    switch {
+    case isVec(n1) && isVec(n2):
+        n = clip(vm.vecLen(n1), 0, vm.vecLen(n2))
+    case isVec(n1) && (isNumber(n2) || op.any != nil):
+        n = vm.vecLen(n1)
+    case isVec(n2) && (isNumber(n1) || op.any != nil):
+        n = vm.vecLen(n2)
+    default:
+        return nill, false
+    }
+    need := 1
+    for i := 0; i < n; i++ {
+        need += vm.bigNeed(op, elem(n1, i), elem(n2, i))
+    }
+    mark := vm.protect(&n1, &n2)
+    vm.reserveVec(n)
+    vm.reserve(need)
+    vm.unprotect(mark)
+    var r []value
+    for i := 0; i < n; i++ {
+        if c, ok := vm.arith(op, elem(n1, i), elem(n2, i)); ok {
+            r = append(r, c)
+        }
+    }
+    return vm.newVec(r), true
+}